@@ -0,0 +1,98 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/do-community/do-ansible-inventory/inventory"
+)
+
+// cacheEntry is the content of the --cache-file
+type cacheEntry struct {
+	Key       string
+	Created   time.Time
+	Inventory *inventory.Inventory
+	Stats     inventory.Stats
+}
+
+// cacheKey hashes the options an inventory is built with and the access token,
+// so that changing them or the account busts the cache
+func cacheKey(cfg inventory.Config, token string) (string, error) {
+	// relative --changed-since, --created-after, and --created-before values
+	// resolve to a new time on every run
+	cfg.ChangedSince = time.Time{}
+	cfg.CreatedAfter = time.Time{}
+	cfg.CreatedBefore = time.Time{}
+
+	b, err := json.Marshal(struct {
+		Config        inventory.Config
+		ChangedSince  string
+		CreatedAfter  string
+		CreatedBefore string
+		Token         string
+	}{cfg, *changedSince, *createdAfter, *createdBefore, token})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadCache returns the cached inventory if the cache file exists, was
+// written for key, and isn't older than ttl
+func loadCache(path, key string, ttl time.Duration) (*inventory.Inventory, inventory.Stats, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, inventory.Stats{}, false
+	}
+	defer f.Close()
+
+	var entry cacheEntry
+	err = gob.NewDecoder(f).Decode(&entry)
+	if err != nil || entry.Key != key || time.Since(entry.Created) > ttl {
+		return nil, inventory.Stats{}, false
+	}
+
+	return entry.Inventory, entry.Stats, true
+}
+
+// writeCache writes the inventory to the cache file. Like the metrics, it's
+// written to a temporary file first and renamed so concurrent runs never read a
+// partial file.
+func writeCache(path, key string, inv *inventory.Inventory, stats inventory.Stats) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = gob.NewEncoder(tmp).Encode(cacheEntry{Key: key, Created: time.Now(), Inventory: inv, Stats: stats})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
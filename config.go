@@ -0,0 +1,167 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// config is the file passed to --config. Options are keyed by their flag
+// name, e.g. `private-ips: true` or `ignore: [web-01, web-02]`. The options of
+// the selected profile apply first, the top-level options override them.
+type config struct {
+	Options  map[string]interface{}            `yaml:",inline"`
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// configArgs returns args with the options of the --config file and its
+// selected --profile prepended as flags. Options for flags that are already set
+// on the command line or through their environment variable are skipped, so
+// the precedence is: profile < config < env < flags.
+func configArgs(args []string) ([]string, error) {
+	pc, err := kingpin.CommandLine.ParseContext(args)
+	if err != nil {
+		// let the real parse report the error
+		return args, nil
+	}
+
+	set := map[string]bool{}
+	var configFile, profile string
+	for _, e := range pc.Elements {
+		f, ok := e.Clause.(*kingpin.FlagClause)
+		if !ok {
+			continue
+		}
+
+		name := f.Model().Name
+		set[name] = true
+		if e.Value == nil {
+			continue
+		}
+
+		switch name {
+		case "config":
+			configFile = *e.Value
+		case "profile":
+			profile = *e.Value
+		}
+	}
+
+	if configFile == "" {
+		if profile != "" {
+			return nil, fmt.Errorf("--profile requires --config")
+		}
+		return args, nil
+	}
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// sources are keyed by option, so errors point at the profile or the file
+	options := make(map[string]interface{}, len(cfg.Options))
+	sources := make(map[string]string, len(cfg.Options))
+	if profile != "" {
+		profileOptions, ok := cfg.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("profile %q not found in %s", profile, configFile)
+		}
+		for name, value := range profileOptions {
+			options[name] = value
+			sources[name] = fmt.Sprintf("profile %q", profile)
+		}
+	}
+	for name, value := range cfg.Options {
+		options[name] = value
+		sources[name] = configFile
+	}
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var extra []string
+	for _, name := range names {
+		value, source := options[name], sources[name]
+		if name == "config" || name == "profile" {
+			return nil, fmt.Errorf("%s: option %q can't be set in the config file", source, name)
+		}
+		flag := kingpin.CommandLine.GetFlag(name)
+		if flag == nil {
+			return nil, fmt.Errorf("%s: unknown option %q", source, name)
+		}
+
+		model := flag.Model()
+		if set[name] || (model.Envar != "" && os.Getenv(model.Envar) != "") {
+			continue
+		}
+
+		fa, err := optionFlags(model, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		extra = append(extra, fa...)
+	}
+
+	return append(extra, args...), nil
+}
+
+// optionFlags converts a config option into command line flags
+func optionFlags(model *kingpin.FlagModel, value interface{}) ([]string, error) {
+	if b, ok := model.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		v, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("option %q must be true or false", model.Name)
+		}
+
+		if v {
+			return []string{"--" + model.Name}, nil
+		}
+		return []string{"--no-" + model.Name}, nil
+	}
+
+	if values, ok := value.([]interface{}); ok {
+		flags := make([]string, 0, len(values))
+		for _, v := range values {
+			flags = append(flags, fmt.Sprintf("--%s=%v", model.Name, v))
+		}
+		return flags, nil
+	}
+
+	return []string{fmt.Sprintf("--%s=%v", model.Name, value)}, nil
+}
+
+func loadConfig(path string) (*config, error) {
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config file: %w", err)
+	}
+
+	cfg := &config{}
+	err = yaml.Unmarshal(f, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal config file: %w", err)
+	}
+
+	return cfg, nil
+}
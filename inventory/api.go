@@ -0,0 +1,675 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/digitalocean/godo"
+)
+
+// DropletLister lists Droplets and their backups, it's implemented by
+// godo.DropletsService
+type DropletLister interface {
+	List(context.Context, *godo.ListOptions) ([]godo.Droplet, *godo.Response, error)
+	ListByTag(context.Context, string, *godo.ListOptions) ([]godo.Droplet, *godo.Response, error)
+	Backups(context.Context, int, *godo.ListOptions) ([]godo.Image, *godo.Response, error)
+}
+
+// ProjectLister lists projects and their resources, it's implemented by
+// godo.ProjectsService
+type ProjectLister interface {
+	List(context.Context, *godo.ListOptions) ([]godo.Project, *godo.Response, error)
+	ListResources(context.Context, string, *godo.ListOptions) ([]godo.ProjectResource, *godo.Response, error)
+}
+
+// RegionLister lists regions, it's implemented by godo.RegionsService
+type RegionLister interface {
+	List(context.Context, *godo.ListOptions) ([]godo.Region, *godo.Response, error)
+}
+
+// LoadBalancerLister lists load balancers, it's implemented by
+// godo.LoadBalancersService
+type LoadBalancerLister interface {
+	List(context.Context, *godo.ListOptions) ([]godo.LoadBalancer, *godo.Response, error)
+}
+
+// DatabaseLister lists managed database clusters, it's implemented by
+// godo.DatabasesService
+type DatabaseLister interface {
+	List(context.Context, *godo.ListOptions) ([]godo.Database, *godo.Response, error)
+}
+
+// FloatingIPLister lists reserved IPs, which godo v1.36 still calls floating
+// IPs, it's implemented by godo.FloatingIPsService
+type FloatingIPLister interface {
+	List(context.Context, *godo.ListOptions) ([]godo.FloatingIP, *godo.Response, error)
+}
+
+// VPCGetter looks up VPCs, it's implemented by godo.VPCsService
+type VPCGetter interface {
+	Get(context.Context, string) (*godo.VPC, *godo.Response, error)
+}
+
+// Client holds the DigitalOcean API calls an inventory is built with. Use
+// NewClient to make one from a godo client, or set the fields to mocks to
+// build inventories from canned responses.
+type Client struct {
+	Droplets      DropletLister
+	Projects      ProjectLister
+	Regions       RegionLister
+	VPCs          VPCGetter
+	LoadBalancers LoadBalancerLister
+	Databases     DatabaseLister
+	FloatingIPs   FloatingIPLister
+}
+
+// NewClient returns a Client calling the DigitalOcean API through client
+func NewClient(client *godo.Client) Client {
+	return Client{
+		Droplets:      client.Droplets,
+		Projects:      client.Projects,
+		Regions:       client.Regions,
+		VPCs:          client.VPCs,
+		LoadBalancers: client.LoadBalancers,
+		Databases:     client.Databases,
+		FloatingIPs:   client.FloatingIPs,
+	}
+}
+
+// vpcGroupNames returns the group names of the VPCs, keyed by UUID. Each VPC
+// is looked up once, VPCs that can't be looked up are named after their UUID.
+// VPC names are only unique within a region, so VPCs whose sanitized names
+// collide are disambiguated by appending their region, or the first 8
+// characters of their UUID if they still collide.
+func (b *builder) vpcGroupNames(ctx context.Context, dropletsByVPC map[string][]string) map[string]string {
+	vpcs := make(map[string]*godo.VPC, len(dropletsByVPC))
+	names := make(map[string]string, len(dropletsByVPC))
+	for uuid := range dropletsByVPC {
+		ll := log.WithField("vpc", uuid)
+		ll.Info("looking up VPC")
+
+		reqCtx, cancel := b.requestContext(ctx)
+		vpc, resp, err := b.client.VPCs.Get(reqCtx, uuid)
+		cancel()
+		err = withRequestID(err, resp)
+		if err != nil || vpc.Name == "" {
+			ll.WithError(err).Warn("couldn't look up the VPC's name, using its UUID")
+			names[uuid] = sanitizeAnsibleGroup("vpc_" + uuid)
+			continue
+		}
+
+		vpcs[uuid] = vpc
+		names[uuid] = sanitizeAnsibleGroup("vpc_" + vpc.Name)
+	}
+
+	counts := make(map[string]int, len(names))
+	for _, name := range names {
+		counts[name]++
+	}
+
+	regional := make(map[string]string, len(vpcs))
+	regionalCounts := make(map[string]int, len(vpcs))
+	for uuid, vpc := range vpcs {
+		if counts[names[uuid]] > 1 {
+			regional[uuid] = sanitizeAnsibleGroup("vpc_" + vpc.Name + "_" + vpc.RegionSlug)
+			regionalCounts[regional[uuid]]++
+		}
+	}
+
+	for uuid, name := range regional {
+		if regionalCounts[name] > 1 || counts[name] > 0 {
+			shortID := uuid
+			if len(shortID) > 8 {
+				shortID = shortID[:8]
+			}
+
+			name = sanitizeAnsibleGroup("vpc_" + vpcs[uuid].Name + "_" + shortID)
+		}
+
+		log.WithField("vpc", vpcs[uuid].Name).WithField("group", name).Warn("multiple VPCs share this name, disambiguating with the VPC's region or UUID")
+		names[uuid] = name
+	}
+
+	return names
+}
+
+// get droplets w/ pagination
+func (b *builder) listDroplets(ctx context.Context, tag string) ([]godo.Droplet, error) {
+	droplets := []godo.Droplet{}
+
+	call := func(ctx context.Context, opt *godo.ListOptions) (interface{}, *godo.Response, error) {
+		if tag != "" {
+			return b.client.Droplets.ListByTag(ctx, tag, opt)
+		}
+
+		return b.client.Droplets.List(ctx, opt)
+	}
+	handler := func(d interface{}) error {
+		dd, ok := d.([]godo.Droplet)
+		if !ok {
+			return fmt.Errorf("listing Droplets")
+		}
+		droplets = append(droplets, dd...)
+		return nil
+	}
+
+	err := b.paginateGodo(ctx, call, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	return droplets, nil
+}
+
+// get regions w/ pagination, keyed by slug
+func (b *builder) listRegions(ctx context.Context) (map[string]godo.Region, error) {
+	regions := map[string]godo.Region{}
+
+	call := func(ctx context.Context, opt *godo.ListOptions) (interface{}, *godo.Response, error) {
+		return b.client.Regions.List(ctx, opt)
+	}
+	handler := func(r interface{}) error {
+		rr, ok := r.([]godo.Region)
+		if !ok {
+			return fmt.Errorf("listing regions")
+		}
+		for _, region := range rr {
+			regions[region.Slug] = region
+		}
+		return nil
+	}
+
+	err := b.paginateGodo(ctx, call, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	return regions, nil
+}
+
+// get load balancers w/ pagination
+func (b *builder) listLoadBalancers(ctx context.Context) ([]godo.LoadBalancer, error) {
+	var lbs []godo.LoadBalancer
+
+	call := func(ctx context.Context, opt *godo.ListOptions) (interface{}, *godo.Response, error) {
+		return b.client.LoadBalancers.List(ctx, opt)
+	}
+	handler := func(l interface{}) error {
+		ll, ok := l.([]godo.LoadBalancer)
+		if !ok {
+			return fmt.Errorf("listing load balancers")
+		}
+		lbs = append(lbs, ll...)
+		return nil
+	}
+
+	err := b.paginateGodo(ctx, call, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	return lbs, nil
+}
+
+// get database clusters w/ pagination
+func (b *builder) listDatabases(ctx context.Context) ([]godo.Database, error) {
+	var dbs []godo.Database
+
+	call := func(ctx context.Context, opt *godo.ListOptions) (interface{}, *godo.Response, error) {
+		return b.client.Databases.List(ctx, opt)
+	}
+	handler := func(d interface{}) error {
+		dd, ok := d.([]godo.Database)
+		if !ok {
+			return fmt.Errorf("listing databases")
+		}
+		dbs = append(dbs, dd...)
+		return nil
+	}
+
+	err := b.paginateGodo(ctx, call, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	return dbs, nil
+}
+
+// listReservedIPs returns the reserved IPs assigned to Droplets, keyed by
+// Droplet ID, listing them w/ pagination
+func (b *builder) listReservedIPs(ctx context.Context) (map[int]string, error) {
+	ips := map[int]string{}
+
+	call := func(ctx context.Context, opt *godo.ListOptions) (interface{}, *godo.Response, error) {
+		return b.client.FloatingIPs.List(ctx, opt)
+	}
+	handler := func(f interface{}) error {
+		ff, ok := f.([]godo.FloatingIP)
+		if !ok {
+			return fmt.Errorf("listing reserved IPs")
+		}
+		for _, ip := range ff {
+			if ip.Droplet != nil {
+				ips[ip.Droplet.ID] = ip.IP
+			}
+		}
+		return nil
+	}
+
+	err := b.paginateGodo(ctx, call, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	return ips, nil
+}
+
+// listLatestBackups looks up the ID of the most recent backup of each Droplet,
+// running up to concurrency lookups at once. Droplets without backups are
+// skipped without an API call and lookup errors are logged, not returned.
+func (b *builder) listLatestBackups(ctx context.Context, droplets []godo.Droplet, concurrency int) map[int]int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, concurrency)
+		backups = make(map[int]int, len(droplets))
+		seen    = make(map[int]bool, len(droplets))
+	)
+	for _, d := range droplets {
+		// only look up each Droplet once
+		if len(d.BackupIDs) == 0 || seen[d.ID] {
+			continue
+		}
+		seen[d.ID] = true
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(d godo.Droplet) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ll := log.WithField("droplet", d.Name)
+			ll.Info("looking up backups")
+
+			images, err := b.listBackups(ctx, d.ID)
+			if err != nil {
+				ll.WithError(err).Error("couldn't list backups, skipping")
+				return
+			}
+
+			var latest *godo.Image
+			for i, image := range images {
+				if latest == nil || image.Created > latest.Created {
+					latest = &images[i]
+				}
+			}
+			if latest == nil {
+				return
+			}
+
+			mu.Lock()
+			backups[d.ID] = latest.ID
+			mu.Unlock()
+		}(d)
+	}
+	wg.Wait()
+
+	return backups
+}
+
+// get droplet backups w/ pagination
+func (b *builder) listBackups(ctx context.Context, dropletID int) ([]godo.Image, error) {
+	images := []godo.Image{}
+
+	call := func(ctx context.Context, opt *godo.ListOptions) (interface{}, *godo.Response, error) {
+		return b.client.Droplets.Backups(ctx, dropletID, opt)
+	}
+	handler := func(i interface{}) error {
+		ii, ok := i.([]godo.Image)
+		if !ok {
+			return fmt.Errorf("listing backups")
+		}
+		images = append(images, ii...)
+		return nil
+	}
+
+	err := b.paginateGodo(ctx, call, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// listDropletsByTags lists the Droplets of each tag concurrently and returns
+// their union. Droplets with several of the tags are only included once.
+func (b *builder) listDropletsByTags(ctx context.Context, tags []string) ([]godo.Droplet, error) {
+	var (
+		wg      sync.WaitGroup
+		results = make([][]godo.Droplet, len(tags))
+		errs    = make([]error, len(tags))
+	)
+	for i, t := range tags {
+		wg.Add(1)
+		go func(i int, t string) {
+			defer wg.Done()
+			results[i], errs[i] = b.listDroplets(ctx, t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("listing Droplets tagged %q: %w", tags[i], err)
+		}
+	}
+
+	// merge in the order the tags were passed to keep the output stable
+	seen := map[int]bool{}
+	droplets := []godo.Droplet{}
+	for _, dd := range results {
+		for _, d := range dd {
+			if seen[d.ID] {
+				continue
+			}
+
+			seen[d.ID] = true
+			droplets = append(droplets, d)
+		}
+	}
+
+	return droplets, nil
+}
+
+// listProjectsResources lists the resources of the projects concurrently and
+// returns them keyed by project ID. The first error cancels the other lookups.
+// If droplets isn't nil, the projects left once every Droplet in it was found
+// aren't looked up, since a Droplet belongs to a single project, and the
+// number of projects skipped is returned.
+func (b *builder) listProjectsResources(ctx context.Context, projects []godo.Project, concurrency int, droplets map[int]string) (map[string][]godo.ProjectResource, int, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, concurrency)
+		resources = make(map[string][]godo.ProjectResource, len(projects))
+		found     = make(map[int]bool, len(droplets))
+		skipped   int
+		firstErr  error
+	)
+	for _, project := range projects {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(project godo.Project) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			mu.Lock()
+			if droplets != nil && len(found) == len(droplets) {
+				skipped++
+				mu.Unlock()
+				log.WithField("project", project.Name).Debug("every Droplet's project is known, skipping project resources")
+				return
+			}
+			mu.Unlock()
+
+			log.WithField("project", project.Name).Info("listing project resources")
+
+			rr, err := b.listProjectResources(ctx, project.ID)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("project %s: %w", project.Name, err)
+					cancel()
+				}
+				return
+			}
+			resources[project.ID] = rr
+			for _, r := range rr {
+				if id, ok := resourceDropletID(r); ok {
+					if _, selected := droplets[id]; selected {
+						found[id] = true
+					}
+				}
+			}
+		}(project)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+
+	return resources, skipped, nil
+}
+
+// resourceDropletID returns the ID of the Droplet a project resource refers
+// to, if it's a Droplet
+func resourceDropletID(r godo.ProjectResource) (int, bool) {
+	if !strings.HasPrefix(r.URN, "do:droplet:") {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URN, "do:droplet:"))
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// get project resources w/ pagination
+func (b *builder) listProjectResources(ctx context.Context, projectID string) ([]godo.ProjectResource, error) {
+	prs := []godo.ProjectResource{}
+
+	call := func(ctx context.Context, opt *godo.ListOptions) (interface{}, *godo.Response, error) {
+		return b.client.Projects.ListResources(ctx, projectID, opt)
+	}
+	handler := func(r interface{}) error {
+		rr, ok := r.([]godo.ProjectResource)
+		if !ok {
+			return fmt.Errorf("listing project resources")
+		}
+		prs = append(prs, rr...)
+		return nil
+	}
+
+	err := b.paginateGodo(ctx, call, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	return prs, nil
+}
+
+// retryAPI calls call until it succeeds, fails with an error that isn't worth
+// retrying, or maxRetries retries were made. Rate limited requests (429 Too
+// Many Requests) are retried after the time in the Retry-After header, or once
+// the rate limit resets. Server errors (500, 502, 503, 504) and network errors
+// are retried with an exponential backoff starting at baseDelay, with jitter.
+func retryAPI(ctx context.Context, maxRetries int, baseDelay time.Duration, call func() (*godo.Response, error)) error {
+	for attempt := 0; ; attempt++ {
+		resp, err := call()
+		if err == nil || attempt >= maxRetries || ctx.Err() != nil {
+			return err
+		}
+
+		var wait time.Duration
+		ll := log.WithField("attempt", attempt+1)
+		switch {
+		case resp != nil && resp.StatusCode == http.StatusTooManyRequests:
+			wait = rateLimitWait(resp, time.Now())
+			ll.WithField("wait", wait).Warn("rate limited by the API, retrying")
+		case isTransient(resp):
+			wait = backoff(baseDelay, attempt)
+			ll.WithError(err).WithField("wait", wait).Warn("API request failed, retrying")
+		default:
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// isTransient returns whether a failed request is worth retrying: the server
+// failed with 500, 502, 503, or 504, or there's no response because of a
+// network error
+func isTransient(resp *godo.Response) bool {
+	if resp == nil || resp.Response == nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns how long to wait before the retry following attempt, which
+// doubles with every attempt. Half of the wait is random so that concurrent
+// runs don't retry in lockstep.
+func backoff(base time.Duration, attempt int) time.Duration {
+	if attempt > 16 {
+		attempt = 16
+	}
+
+	d := base << uint(attempt)
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// rateLimitWait returns how long to wait before retrying a rate limited
+// request, at least a second
+func rateLimitWait(resp *godo.Response, now time.Time) time.Duration {
+	wait := time.Second
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		if d := time.Duration(s) * time.Second; d > wait {
+			wait = d
+		}
+	} else if d := resp.Rate.Reset.Time.Sub(now); d > wait {
+		wait = d
+	}
+
+	return wait
+}
+
+// withRequestID adds the x-request-id header of the response to the error of a
+// failed request, DigitalOcean's support asks for it. Errors that already carry
+// the request ID from the response body are returned as is.
+func withRequestID(err error, resp *godo.Response) error {
+	if err == nil || resp == nil || resp.Response == nil {
+		return err
+	}
+
+	id := resp.Header.Get("x-request-id")
+	if id == "" {
+		return err
+	}
+
+	var errResp *godo.ErrorResponse
+	if errors.As(err, &errResp) && errResp.RequestID != "" {
+		return err
+	}
+	return fmt.Errorf("%w (request %q)", err, id)
+}
+
+// requestContext returns the context of a single API request, which times out
+// after Config.RequestTimeout if it's set
+func (b *builder) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.cfg.RequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, b.cfg.RequestTimeout)
+}
+
+func (b *builder) paginateGodo(ctx context.Context, call func(context.Context, *godo.ListOptions) (interface{}, *godo.Response, error), handler func(interface{}) error) error {
+	// create options. initially, these will be blank apart from the page size
+	opt := &godo.ListOptions{PerPage: b.cfg.PerPage}
+	for {
+		var (
+			results interface{}
+			resp    *godo.Response
+		)
+		err := retryAPI(ctx, b.cfg.MaxRetries, b.cfg.RetryBaseDelay, func() (*godo.Response, error) {
+			reqCtx, cancel := b.requestContext(ctx)
+			defer cancel()
+
+			var err error
+			results, resp, err = call(reqCtx, opt)
+			if err != nil && reqCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+				page := opt.Page
+				if page == 0 {
+					page = 1
+				}
+				log.WithError(err).WithField("page", page).WithField("timeout", b.cfg.RequestTimeout).Warn("API request timed out")
+			}
+			return resp, err
+		})
+		if err != nil {
+			return withRequestID(err, resp)
+		}
+
+		err = handler(results)
+		if err != nil {
+			return err
+		}
+
+		// if we are at the last page, break out the for loop
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return err
+		}
+
+		// set the page we want for the next request
+		opt.Page = page + 1
+	}
+
+	return nil
+}
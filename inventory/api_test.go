@@ -0,0 +1,41 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestPaginateGodoHandlerError(t *testing.T) {
+	b := &builder{client: Client{Droplets: &fakeDroplets{droplets: []godo.Droplet{
+		testDroplet(1, "web-01", "nyc3", "203.0.113.1"),
+	}}}}
+
+	call := func(ctx context.Context, opt *godo.ListOptions) (interface{}, *godo.Response, error) {
+		return b.client.Droplets.List(ctx, opt)
+	}
+	handlerErr := errors.New("handler failed")
+	handler := func(interface{}) error {
+		return handlerErr
+	}
+
+	err := b.paginateGodo(context.Background(), call, handler)
+	if !errors.Is(err, handlerErr) {
+		t.Errorf("paginateGodo() error = %v, want %v", err, handlerErr)
+	}
+}
@@ -0,0 +1,1034 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/digitalocean/godo"
+)
+
+// Stats counts the Droplets and hosts of a build
+type Stats struct {
+	DropletsListed  int
+	DropletsIgnored int
+	HostsSkipped    int
+	// NoIP are the names of the Droplets skipped because their IP address
+	// couldn't be looked up
+	NoIP []string
+	// Duplicates are the names of the Droplets skipped because their host name
+	// was already used
+	Duplicates []string
+	// Skipped are the names of all the skipped Droplets, the ones in NoIP and
+	// Duplicates and the locked or transitional ones with GroupByLifecycle
+	Skipped []string
+	// NoAddress are the host names of the Droplets without an IP address,
+	// which are added without ansible_host so Ansible connects to the name
+	NoAddress []string
+}
+
+// dropletHost is a Droplet selected as a host, with its host name and the
+// address used as its ansible_host
+type dropletHost struct {
+	droplet godo.Droplet
+	name    string
+	ip      string
+	// dropletAddress is the Droplet's own address if ip is a reserved IP
+	dropletAddress string
+	overridden     bool
+	stage          string
+}
+
+// builder holds the state of a build
+type builder struct {
+	cfg    Config
+	client Client
+	now    time.Time
+
+	// ipOverrides are the addresses set with Config.HostOverrides, keyed by
+	// Droplet name
+	ipOverrides map[string]string
+	// preferNetwork is the parsed Config.PreferCIDR, if it's set
+	preferNetwork *net.IPNet
+}
+
+// Build lists the account's Droplets and builds their inventory according to
+// cfg. If building the groups fails, the inventory assembled so far is
+// returned along with the error.
+func Build(ctx context.Context, client Client, cfg Config) (*Inventory, Stats, error) {
+	var stats Stats
+
+	err := cfg.Validate()
+	if err != nil {
+		return nil, stats, err
+	}
+	if len(cfg.IPFamilies) == 0 {
+		cfg.IPFamilies = []string{"ipv4"}
+	}
+	if cfg.HostAliasFrom == "" {
+		cfg.HostAliasFrom = "name"
+	}
+	if cfg.RetryBaseDelay == 0 {
+		cfg.RetryBaseDelay = time.Second
+	}
+	if cfg.PerPage > MaxPerPage {
+		log.WithField("per_page", cfg.PerPage).Warnf("the API returns at most %d items per page, using %d", MaxPerPage, MaxPerPage)
+		cfg.PerPage = MaxPerPage
+	}
+
+	b := &builder{cfg: cfg, client: client, now: time.Now()}
+
+	b.ipOverrides, err = parseIPOverrides(cfg.HostOverrides)
+	if err != nil {
+		return nil, stats, fmt.Errorf("--host-override: %w", err)
+	}
+
+	if cfg.PreferCIDR != "" {
+		_, b.preferNetwork, err = net.ParseCIDR(cfg.PreferCIDR)
+		if err != nil {
+			return nil, stats, fmt.Errorf("--network-prefer-cidr: %w", err)
+		}
+	}
+
+	ignorePatterns, err := compileIgnoreRegex(cfg.IgnoreRegex)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	excludeClauses := make([]excludeClause, 0, len(cfg.ExcludeWhere))
+	for _, w := range cfg.ExcludeWhere {
+		c, err := parseExcludeClause(w)
+		if err != nil {
+			return nil, stats, fmt.Errorf("--exclude-where: %w", err)
+		}
+		excludeClauses = append(excludeClauses, c)
+	}
+
+	extraArgs, err := parseKeyValues(cfg.SSHExtraArgsFor)
+	if err != nil {
+		return nil, stats, fmt.Errorf("--ssh-extra-args-for: %w", err)
+	}
+
+	tagUsers, err := parseKeyValues(cfg.SSHUserForTag)
+	if err != nil {
+		return nil, stats, fmt.Errorf("--ssh-user-for-tag: %w", err)
+	}
+
+	tagKeyFiles, err := parseKeyValues(cfg.SSHKeyFileForTag)
+	if err != nil {
+		return nil, stats, fmt.Errorf("--ssh-key-file-for-tag: %w", err)
+	}
+
+	memoryBuckets, err := parseMemoryBuckets(cfg.MemoryBuckets)
+	if err != nil {
+		return nil, stats, fmt.Errorf("--memory-buckets: %w", err)
+	}
+
+	// get droplets
+	listTag := cfg.Tag
+	if listTag == "" && len(cfg.TagRequireAll) > 0 && len(cfg.TagsUnion) == 0 {
+		// every selected Droplet must have the first required tag, so let the
+		// API do the first pass
+		listTag = cfg.TagRequireAll[0]
+	}
+	if listTag != "" {
+		log.WithField("tag", listTag).Info("only selecting tagged Droplets")
+	}
+
+	var droplets []godo.Droplet
+	if len(cfg.TagsUnion) > 0 {
+		log.WithField("tags", strings.Join(cfg.TagsUnion, ",")).Info("listing Droplets by tags")
+		droplets, err = b.listDropletsByTags(ctx, cfg.TagsUnion)
+	} else {
+		log.Info("listing Droplets")
+		droplets, err = b.listDroplets(ctx, listTag)
+	}
+	if err != nil {
+		return nil, stats, fmt.Errorf("couldn't fetch Droplets: %w", err)
+	}
+	stats.DropletsListed = len(droplets)
+
+	// check the IDs against the whole listing, IDs of Droplets removed by the
+	// other filters aren't missing. A listing by tag doesn't have every
+	// Droplet of the account though, so an ID missing from it may still exist.
+	notFound := "not found in the account"
+	if listTag != "" || len(cfg.TagsUnion) > 0 {
+		notFound = "not matched by the current filters"
+	}
+	for _, id := range missingIDs(droplets, cfg.IncludeIDs) {
+		log.WithField("id", id).Warn("Droplet ID " + notFound)
+	}
+
+	if len(cfg.DropletIDs) > 0 {
+		if missing := missingIDs(droplets, cfg.DropletIDs); len(missing) > 0 {
+			return nil, stats, fmt.Errorf("--droplet-id: Droplet IDs %s: %s", notFound, strings.Join(missing, ", "))
+		}
+		log.WithField("ids", len(cfg.DropletIDs)).Info("only selecting Droplets by --droplet-id")
+		droplets = filterIDs(droplets, cfg.DropletIDs)
+	}
+
+	if len(cfg.IncludeRegions) > 0 || len(cfg.ExcludeRegions) > 0 {
+		warnUnknownRegions(append(append([]string{}, cfg.IncludeRegions...), cfg.ExcludeRegions...))
+		log.WithField("regions", strings.Join(cfg.IncludeRegions, ",")).WithField("excluded", strings.Join(cfg.ExcludeRegions, ",")).Info("only selecting Droplets by region")
+		droplets = filterRegions(droplets, cfg.IncludeRegions, cfg.ExcludeRegions)
+	}
+
+	if len(cfg.TagRequireAll) > 0 || len(cfg.TagRequireAny) > 0 {
+		droplets = filterTags(droplets, cfg.TagRequireAll, cfg.TagRequireAny)
+	}
+
+	if len(cfg.Statuses) > 0 {
+		log.WithField("status", strings.Join(cfg.Statuses, ",")).Info("only selecting Droplets by status")
+		droplets = filterStatus(droplets, cfg.Statuses)
+	}
+
+	if !cfg.ChangedSince.IsZero() {
+		log.WithField("since", cfg.ChangedSince.Format(time.RFC3339)).Info("only selecting Droplets changed since")
+		droplets = filterCreated(droplets, cfg.ChangedSince, time.Time{})
+	}
+
+	if !cfg.CreatedAfter.IsZero() || !cfg.CreatedBefore.IsZero() {
+		total := len(droplets)
+		droplets = filterCreated(droplets, cfg.CreatedAfter, cfg.CreatedBefore)
+
+		ll := log.WithField("excluded", total-len(droplets))
+		if !cfg.CreatedAfter.IsZero() {
+			ll = ll.WithField("after", cfg.CreatedAfter.Format(time.RFC3339))
+		}
+		if !cfg.CreatedBefore.IsZero() {
+			ll = ll.WithField("before", cfg.CreatedBefore.Format(time.RFC3339))
+		}
+		ll.Info("selected Droplets created in the date window")
+	}
+
+	if len(cfg.NameMatch) > 0 || cfg.NamePrefix != "" {
+		log.WithField("match", strings.Join(cfg.NameMatch, ",")).WithField("prefix", cfg.NamePrefix).Info("only selecting Droplets by name")
+		droplets = filterNames(droplets, cfg.NameMatch, cfg.NamePrefix, cfg.IgnoreCase)
+	}
+
+	if cfg.IncludeIDs != nil {
+		log.WithField("ids", len(cfg.IncludeIDs)).Info("only selecting Droplets by ID")
+		droplets = filterIDs(droplets, cfg.IncludeIDs)
+	}
+
+	// filter out ignored droplets
+	droplets = removeIgnored(droplets, cfg.Ignore, cfg.IgnoreCase, cfg.IgnoreTags, ignorePatterns)
+
+	if len(excludeClauses) > 0 {
+		droplets = removeExcludedWhere(droplets, excludeClauses)
+	}
+
+	if cfg.GPUOnly {
+		log.Info("only selecting GPU Droplets")
+		droplets = filterGPU(droplets, cfg.GPUSizePrefixes)
+	}
+
+	stats.DropletsIgnored = stats.DropletsListed - len(droplets)
+
+	warnUnusedOverrides(droplets, b.ipOverrides)
+
+	// initialize some maps
+	var dropletsByRegion map[string][]string
+	if b.cfg.GroupByRegion {
+		regions := b.cfg.Regions
+		if regions == nil {
+			regions = DefaultRegions
+		}
+
+		// Droplets in other regions add their region's group as well
+		dropletsByRegion = make(map[string][]string, len(regions))
+		for _, r := range regions {
+			dropletsByRegion[r] = []string{}
+		}
+	}
+
+	var dropletsByTag map[string][]string
+	if b.cfg.GroupByTag {
+		dropletsByTag = make(map[string][]string, 0)
+	}
+
+	var gpuDroplets []string
+
+	var dropletsByImage map[string][]string
+	if b.cfg.GroupByImage {
+		dropletsByImage = make(map[string][]string)
+	}
+
+	// featureHosts are all the hosts, to build the groups of the hosts
+	// lacking a feature
+	var dropletsByFeature map[string][]string
+	var featureHosts []string
+	if b.cfg.GroupByFeature {
+		dropletsByFeature = make(map[string][]string)
+	}
+
+	var dropletsByVPC map[string][]string
+	if b.cfg.GroupByVPC {
+		dropletsByVPC = make(map[string][]string)
+	}
+
+	var dropletsByNamePrefix map[string][]string
+	if b.cfg.GroupByNamePrefix {
+		dropletsByNamePrefix = make(map[string][]string)
+	}
+
+	var dropletsBySubnet map[string][]string
+	if b.cfg.GroupByPrivateSubnet {
+		dropletsBySubnet = make(map[string][]string)
+	}
+
+	var dropletsByLifecycle map[string][]string
+	if b.cfg.GroupByLifecycle {
+		dropletsByLifecycle = make(map[string][]string, 3)
+	}
+
+	var dropletsByVCPUs map[int][]string
+	if b.cfg.GroupByVCPUs {
+		dropletsByVCPUs = make(map[int][]string)
+	}
+
+	// Droplets are grouped by their exact memory, or by tier if there are
+	// memory buckets
+	var dropletsByMemory map[int][]string
+	var dropletsByMemoryTier map[string][]string
+	if b.cfg.GroupByMemory {
+		dropletsByMemory = make(map[int][]string)
+		dropletsByMemoryTier = make(map[string][]string, len(memoryBuckets))
+	}
+
+	var latestBackups map[int]int
+	if b.cfg.IncludeBackupIDs {
+		log.WithField("droplets", len(droplets)).Warn("looking up backups, this makes an extra API call for every Droplet with backups")
+		latestBackups = b.listLatestBackups(ctx, droplets, b.cfg.BackupLookupConcurrency)
+	}
+
+	var reservedIPs map[int]string
+	if b.cfg.PreferReservedIP {
+		log.Info("listing reserved IPs")
+		reservedIPs, err = b.listReservedIPs(ctx)
+		if err != nil {
+			return nil, stats, fmt.Errorf("couldn't list reserved IPs: %w", err)
+		}
+	}
+
+	inv := &Inventory{}
+	if b.cfg.EmitAllGroup {
+		// add the all group first so it's at the top of the inventory
+		inv.group("all")
+	}
+	dropletsByID := make(map[int]string, len(droplets))
+	hostIPs := make(map[string]string, len(droplets))
+	aliases := make(map[string]bool, len(droplets))
+
+	proxyCommand := ""
+	if b.cfg.Bastion != "" {
+		address := bastionAddress(droplets, b.cfg.Bastion)
+		if b.cfg.SSHUser != "" {
+			address = b.cfg.SSHUser + "@" + address
+		}
+		log.WithField("bastion", address).Info("connecting through bastion")
+		proxyCommand = fmt.Sprintf(`-o ProxyCommand="ssh -W %%h:%%p %s"`, address)
+	}
+
+	insecureTags := make(map[string]interface{}, len(b.cfg.InsecureHostKeysTags))
+	for _, t := range b.cfg.InsecureHostKeysTags {
+		insecureTags[t] = struct{}{}
+	}
+	if b.cfg.InsecureHostKeys || len(insecureTags) > 0 {
+		log.Warn("host key checking is disabled, hosts' identities won't be verified")
+	}
+
+	// pick the host names and addresses in the API's order, so which Droplet
+	// keeps a duplicate name doesn't depend on --sort-hosts
+	var hosts []dropletHost
+	resolvedDroplets := b.resolveDroplets(droplets, b.cfg.ResolveConcurrency)
+	for i, d := range droplets {
+		ll := log.WithField("droplet", d.Name)
+		ll.Info("processing")
+
+		// skipped Droplets mustn't take a host name or end up in any group
+		ip, err := resolvedDroplets[i].ip, resolvedDroplets[i].ipErr
+		if err != nil {
+			ll.WithError(err).Debug("couldn't look up the Droplet's IP address, skipped")
+			stats.HostsSkipped++
+			stats.NoIP = append(stats.NoIP, d.Name)
+			stats.Skipped = append(stats.Skipped, d.Name)
+			continue
+		}
+
+		// locked and transitional Droplets, e.g. ones being deleted, shouldn't
+		// be targeted at all
+		stage := lifecycleGroup(d, b.cfg.LifecycleNewAge, b.now)
+		if stage == "" {
+			ll.WithField("status", d.Status).WithField("locked", d.Locked).Debug("Droplet is locked or in a transitional state, skipped")
+			stats.HostsSkipped++
+			stats.Skipped = append(stats.Skipped, d.Name)
+			continue
+		}
+
+		name, err := resolvedDroplets[i].alias, resolvedDroplets[i].aliasErr
+		if err != nil {
+			ll.WithError(err).Warn("couldn't get the host alias, using the Droplet's name")
+			name = d.Name
+		}
+		if aliases[name] {
+			switch b.cfg.Dedupe {
+			case "skip":
+				ll.WithField("host", name).Debug("host name already used, skipped")
+				stats.HostsSkipped++
+				stats.Duplicates = append(stats.Duplicates, d.Name)
+				stats.Skipped = append(stats.Skipped, d.Name)
+				continue
+			case "error":
+				return inv, stats, fmt.Errorf("host name %s of Droplet %d is already used", name, d.ID)
+			}
+
+			alias := fmt.Sprintf("%s-%d", name, d.ID)
+			ll.WithField("host", name).Warnf("host name already used, using %s", alias)
+			name = alias
+		}
+		aliases[name] = true
+
+		h := dropletHost{droplet: d, name: name, ip: ip, stage: stage}
+		_, h.overridden = b.ipOverrides[d.Name]
+		if reserved, ok := reservedIPs[d.ID]; ok && !h.overridden {
+			h.dropletAddress, h.ip = h.ip, reserved
+		}
+		if proxyCommand != "" && b.cfg.PrivateIPs && !h.overridden && isBastion(d, b.cfg.Bastion, b.cfg.BastionTag) {
+			// the bastion has to be reachable from the control machine
+			if public, err := d.PublicIPv4(); err == nil && public != "" {
+				h.ip = public
+			}
+		}
+		hosts = append(hosts, h)
+	}
+
+	// sort by the addresses that end up in ansible_host
+	if b.cfg.SortHostsBy != "" {
+		sort.SliceStable(hosts, func(i, j int) bool {
+			a, c := hosts[i], hosts[j]
+			return hostLess(b.cfg.SortHostsBy, a.name, a.ip, c.name, c.ip)
+		})
+	}
+
+	for _, h := range hosts {
+		d, name, ip, stage := h.droplet, h.name, h.ip, h.stage
+		ll := log.WithField("droplet", d.Name)
+
+		dropletsByID[d.ID] = name
+
+		if b.cfg.GroupByRegion {
+			r := d.Region.Slug
+			dropletsByRegion[r] = append(dropletsByRegion[r], name)
+		}
+
+		if b.cfg.GroupByTag {
+			for _, tag := range d.Tags {
+				dropletsByTag[tag] = append(dropletsByTag[tag], name)
+			}
+		}
+
+		if b.cfg.GroupByImage {
+			if image := imageGroup(d); image != "" {
+				dropletsByImage[image] = append(dropletsByImage[image], name)
+			} else {
+				ll.Warn("Droplet's image has no slug or distribution, not grouping by image")
+			}
+		}
+
+		if b.cfg.GroupByFeature {
+			for _, feature := range d.Features {
+				dropletsByFeature[feature] = append(dropletsByFeature[feature], name)
+			}
+			featureHosts = append(featureHosts, name)
+		}
+
+		if b.cfg.GroupByVPC && d.VPCUUID != "" {
+			dropletsByVPC[d.VPCUUID] = append(dropletsByVPC[d.VPCUUID], name)
+		}
+
+		if b.cfg.GroupByGPU && isGPUDroplet(d, b.cfg.GPUSizePrefixes) {
+			gpuDroplets = append(gpuDroplets, name)
+		}
+
+		if b.cfg.GroupByNamePrefix {
+			// Droplets without the delimiter are grouped by their full name
+			prefix := strings.SplitN(d.Name, b.cfg.NamePrefixDelimiter, 2)[0]
+			if prefix != "" {
+				prefix = sanitizeAnsibleGroup(prefix)
+				dropletsByNamePrefix[prefix] = append(dropletsByNamePrefix[prefix], name)
+			}
+		}
+
+		if b.cfg.GroupByLifecycle {
+			dropletsByLifecycle[stage] = append(dropletsByLifecycle[stage], name)
+		}
+
+		if b.cfg.GroupByPrivateSubnet {
+			subnet, err := privateSubnetGroup(d, b.cfg.PrivateSubnetMask)
+			if err != nil {
+				ll.WithError(err).Warn("not grouping by private subnet")
+			} else {
+				dropletsBySubnet[subnet] = append(dropletsBySubnet[subnet], name)
+			}
+		}
+
+		if b.cfg.GroupByVCPUs {
+			dropletsByVCPUs[d.Vcpus] = append(dropletsByVCPUs[d.Vcpus], name)
+		}
+
+		if b.cfg.GroupByMemory && len(memoryBuckets) == 0 {
+			dropletsByMemory[d.Memory] = append(dropletsByMemory[d.Memory], name)
+		} else if b.cfg.GroupByMemory {
+			if tier := memoryTier(d, memoryBuckets); tier != "" {
+				dropletsByMemoryTier[tier] = append(dropletsByMemoryTier[tier], name)
+			} else {
+				ll.WithField("memory", d.Memory).Warn("Droplet has more memory than the largest memory bucket, not grouping by memory")
+			}
+		}
+
+		overridden, dropletAddress := h.overridden, h.dropletAddress
+		hostIPs[name] = ip
+
+		var vars []variable
+		if users := tagValues(d, tagUsers); len(users) > 0 {
+			if len(users) > 1 {
+				ll.WithField("user", users[0]).Info("several --ssh-user-for-tag mappings match, using the first")
+			}
+			vars = append(vars, variable{"ansible_user", users[0]})
+		} else if b.cfg.SSHUser != "" && !b.cfg.ConnectionVarsAtGroupLevel {
+			vars = append(vars, variable{"ansible_user", b.cfg.SSHUser})
+		}
+		if b.cfg.SSHPort != 0 && !b.cfg.ConnectionVarsAtGroupLevel {
+			vars = append(vars, variable{"ansible_port", b.cfg.SSHPort})
+		}
+		if keyFiles := tagValues(d, tagKeyFiles); len(keyFiles) > 0 {
+			if len(keyFiles) > 1 {
+				ll.WithField("key_file", keyFiles[0]).Info("several --ssh-key-file-for-tag mappings match, using the first")
+			}
+			vars = append(vars, variable{"ansible_ssh_private_key_file", keyFiles[0]})
+		} else if b.cfg.SSHKeyFile != "" {
+			vars = append(vars, variable{"ansible_ssh_private_key_file", b.cfg.SSHKeyFile})
+		}
+		if interpreter := dropletPythonInterpreter(d, b.cfg.PythonInterpreter); interpreter != "" {
+			vars = append(vars, variable{"ansible_python_interpreter", interpreter})
+		}
+		fqdn := ""
+		if b.cfg.FQDNDomain != "" {
+			fqdn = dropletFQDN(d.Name, b.cfg.FQDNDomain)
+		}
+		switch {
+		case b.cfg.UseFQDN && !overridden:
+			vars = append(vars, variable{"ansible_host", fqdn})
+			if ip != "" {
+				vars = append(vars, variable{"do_ip", ip})
+			}
+		case ip != "":
+			vars = append(vars, variable{"ansible_host", ip})
+		default:
+			ll.Debug("could not get the Droplet's IP address, using hostname")
+			stats.NoAddress = append(stats.NoAddress, name)
+		}
+		if dropletAddress != "" {
+			vars = append(vars, variable{"do_droplet_ip", dropletAddress})
+		}
+		if fqdn != "" {
+			vars = append(vars, variable{"do_fqdn", fqdn})
+		}
+		if args := tagValues(d, extraArgs); len(args) > 0 {
+			vars = append(vars, variable{"ansible_ssh_extra_args", strings.Join(args, " ")})
+		}
+		var commonArgs []string
+		if proxyCommand != "" && !isBastion(d, b.cfg.Bastion, b.cfg.BastionTag) {
+			commonArgs = append(commonArgs, proxyCommand)
+		}
+		if _, insecure := hasAnyTag(d, insecureTags); insecure || b.cfg.InsecureHostKeys {
+			commonArgs = append(commonArgs, "-o StrictHostKeyChecking=no")
+		}
+		if len(commonArgs) > 0 {
+			vars = append(vars, variable{"ansible_ssh_common_args", strings.Join(commonArgs, " ")})
+		}
+		if b.cfg.HostVars {
+			vars = append(vars, variable{"do_droplet_id", d.ID}, variable{"do_region", d.Region.Slug})
+		}
+		if b.cfg.FeaturesAsVar {
+			vars = append(vars, variable{"do_features", strings.Join(d.Features, ",")})
+		}
+		if b.cfg.TagsAsVar {
+			vars = append(vars, variable{"do_tags", tagsList(d)})
+		}
+		if b.cfg.TagVars {
+			vars = append(vars, tagVars(d, b.cfg.TagVarsSeparator)...)
+		}
+		if id, ok := latestBackups[d.ID]; ok {
+			vars = append(vars, variable{"do_latest_backup_id", id})
+		}
+		if b.cfg.IncludePanelURL {
+			vars = append(vars, variable{"do_panel_url", fmt.Sprintf("https://cloud.digitalocean.com/droplets/%d", d.ID)})
+		}
+
+		h := inv.addHost(name, vars)
+		h.region, h.tags = d.Region.Slug, d.Tags
+	}
+
+	// set the connection vars once for every host
+	if b.cfg.ConnectionVarsAtGroupLevel && (b.cfg.SSHUser != "" || b.cfg.SSHPort != 0) {
+		all := inv.group("all")
+		if b.cfg.SSHUser != "" {
+			all.setVar("ansible_user", b.cfg.SSHUser)
+		}
+		if b.cfg.SSHPort != 0 {
+			all.setVar("ansible_port", b.cfg.SSHPort)
+		}
+	}
+
+	// build the region groups
+	if b.cfg.GroupByRegion {
+		var regions map[string]godo.Region
+		if b.cfg.RegionVars {
+			log.Info("listing regions")
+			regions, err = b.listRegions(ctx)
+			if err != nil {
+				log.WithError(err).Warn("couldn't list regions, skipping region vars")
+			}
+		}
+
+		// sort the regions to maintain alphabetic order
+		regionNames := make([]string, 0, len(dropletsByRegion))
+		for region := range dropletsByRegion {
+			regionNames = append(regionNames, region)
+		}
+		sort.Strings(regionNames)
+
+		regionGroups := make([]string, 0, len(regionNames))
+		for _, region := range regionNames {
+			group := sanitizeAnsibleGroup(b.cfg.RegionPrefix + region)
+			regionGroups = append(regionGroups, group)
+
+			log.WithField("region", group).Info("building region group")
+			g := inv.group(group)
+			g.kind = "region"
+			g.addHosts(dropletsByRegion[region]...)
+
+			if r, ok := regions[region]; ok {
+				g.setVar("do_region_available", r.Available)
+				g.setVar("do_region_features", strings.Join(r.Features, ","))
+			}
+		}
+
+		if b.cfg.RegionParent != "" {
+			parent := sanitizeAnsibleGroup(b.cfg.RegionParent)
+			log.WithField("parent", parent).Info("building region parent group")
+			inv.group(parent).addChildren(regionGroups...)
+		}
+	}
+
+	// tag and project groups are built from maps, sort their hosts by name
+	// unless --sort-hosts says otherwise so the output is stable between runs
+	groupSortKey := b.cfg.SortHostsBy
+	if groupSortKey == "" {
+		groupSortKey = "name"
+	}
+
+	// build the tag groups
+	if b.cfg.GroupByTag {
+		tags := make([]string, 0, len(dropletsByTag))
+		for tag := range dropletsByTag {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+
+		var tagGroups []string
+		seen := make(map[string]bool, len(tags))
+		for _, tag := range tags {
+			droplets := dropletsByTag[tag]
+			sortHosts(droplets, hostIPs, groupSortKey)
+
+			tag = sanitizeAnsibleGroup(b.cfg.TagPrefix + tag)
+			log.WithField("tag", tag).Info("building tag group")
+			g := inv.group(tag)
+			g.kind = "tag"
+			g.addHosts(droplets...)
+
+			if !seen[tag] {
+				seen[tag] = true
+				tagGroups = append(tagGroups, tag)
+			}
+		}
+
+		if b.cfg.TagParent != "" {
+			parent := sanitizeAnsibleGroup(b.cfg.TagParent)
+			log.WithField("parent", parent).Info("building tag parent group")
+			inv.group(parent).addChildren(tagGroups...)
+		}
+
+		if b.cfg.HierarchicalTags {
+			children := tagHierarchy(dropletsByTag, b.cfg.TagPrefix)
+
+			parents := make([]string, 0, len(children))
+			for parent := range children {
+				parents = append(parents, parent)
+			}
+			sort.Strings(parents)
+
+			for _, parent := range parents {
+				log.WithField("tag", parent).Info("building tag hierarchy group")
+				inv.group(parent).addChildren(children[parent]...)
+			}
+		}
+	}
+
+	// build the feature groups and the groups of the hosts lacking each feature
+	if b.cfg.GroupByFeature {
+		features := make([]string, 0, len(dropletsByFeature))
+		for feature := range dropletsByFeature {
+			features = append(features, feature)
+		}
+		sort.Strings(features)
+
+		for _, feature := range features {
+			log.WithField("feature", feature).Info("building feature groups")
+
+			hosts := dropletsByFeature[feature]
+			inv.group(sanitizeAnsibleGroup("feature_" + feature)).addHosts(hosts...)
+
+			has := make(map[string]bool, len(hosts))
+			for _, h := range hosts {
+				has[h] = true
+			}
+			var lacking []string
+			for _, h := range featureHosts {
+				if !has[h] {
+					lacking = append(lacking, h)
+				}
+			}
+			inv.group(sanitizeAnsibleGroup("no_" + feature)).addHosts(lacking...)
+		}
+	}
+
+	// build the image groups
+	if b.cfg.GroupByImage {
+		images := make([]string, 0, len(dropletsByImage))
+		for image := range dropletsByImage {
+			images = append(images, image)
+		}
+		sort.Strings(images)
+
+		for _, image := range images {
+			log.WithField("image", image).Info("building image group")
+			inv.group(image).addHosts(dropletsByImage[image]...)
+		}
+	}
+
+	// build the VPC groups
+	if b.cfg.GroupByVPC {
+		groups := b.vpcGroupNames(ctx, dropletsByVPC)
+
+		vpcs := make([]string, 0, len(dropletsByVPC))
+		for vpc := range dropletsByVPC {
+			vpcs = append(vpcs, vpc)
+		}
+		sort.Slice(vpcs, func(i, j int) bool {
+			return groups[vpcs[i]] < groups[vpcs[j]]
+		})
+
+		for _, vpc := range vpcs {
+			log.WithField("vpc", groups[vpc]).Info("building VPC group")
+			inv.group(groups[vpc]).addHosts(dropletsByVPC[vpc]...)
+		}
+	}
+
+	// build the gpu group
+	if b.cfg.GroupByGPU && len(gpuDroplets) > 0 {
+		log.Info("building gpu group")
+		inv.group("gpu").addHosts(gpuDroplets...)
+	}
+
+	// build the name prefix groups
+	if b.cfg.GroupByNamePrefix {
+		prefixes := make([]string, 0, len(dropletsByNamePrefix))
+		for prefix := range dropletsByNamePrefix {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+
+		for _, prefix := range prefixes {
+			log.WithField("prefix", prefix).Info("building name prefix group")
+			inv.group(prefix).addHosts(dropletsByNamePrefix[prefix]...)
+		}
+	}
+
+	// build the private subnet groups
+	if b.cfg.GroupByPrivateSubnet {
+		subnets := make([]string, 0, len(dropletsBySubnet))
+		for subnet := range dropletsBySubnet {
+			subnets = append(subnets, subnet)
+		}
+		sort.Strings(subnets)
+
+		for _, subnet := range subnets {
+			log.WithField("subnet", subnet).Info("building private subnet group")
+			inv.group(subnet).addHosts(dropletsBySubnet[subnet]...)
+		}
+	}
+
+	// build the lifecycle groups
+	if b.cfg.GroupByLifecycle {
+		for _, stage := range []string{"lifecycle_new", "lifecycle_active", "lifecycle_off"} {
+			if len(dropletsByLifecycle[stage]) == 0 {
+				continue
+			}
+
+			log.WithField("lifecycle", stage).Info("building lifecycle group")
+			inv.group(stage).addHosts(dropletsByLifecycle[stage]...)
+		}
+	}
+
+	// build the vCPU groups
+	if b.cfg.GroupByVCPUs {
+		counts := make([]int, 0, len(dropletsByVCPUs))
+		for count := range dropletsByVCPUs {
+			counts = append(counts, count)
+		}
+		sort.Ints(counts)
+
+		for _, count := range counts {
+			log.WithField("vcpus", count).Info("building vCPU group")
+			inv.group(fmt.Sprintf("vcpus_%d", count)).addHosts(dropletsByVCPUs[count]...)
+		}
+	}
+
+	// build the memory groups, every memory bucket gets a group even if it's
+	// empty
+	if b.cfg.GroupByMemory {
+		sizes := make([]int, 0, len(dropletsByMemory))
+		for size := range dropletsByMemory {
+			sizes = append(sizes, size)
+		}
+		sort.Ints(sizes)
+
+		for _, size := range sizes {
+			log.WithField("memory", size).Info("building memory group")
+			inv.group(fmt.Sprintf("mem_%d", size)).addHosts(dropletsByMemory[size]...)
+		}
+
+		for _, bucket := range memoryBuckets {
+			log.WithField("memory", bucket.group).Info("building memory group")
+			inv.group(bucket.group).addHosts(dropletsByMemoryTier[bucket.group]...)
+		}
+	}
+
+	// build the project groups
+	var dropletsByProject map[string][]string
+	if b.cfg.GroupByProject {
+		log.Info("listing projects")
+		reqCtx, cancel := b.requestContext(ctx)
+		projects, resp, err := b.client.Projects.List(reqCtx, nil)
+		cancel()
+		if err != nil {
+			return inv, stats, fmt.Errorf("couldn't list projects: %w", withRequestID(err, resp))
+		}
+
+		// projects are keyed by ID since several projects can share a name
+		projectGroups := projectGroupNames(projects, b.cfg.ProjectPrefix)
+
+		selected := projects[:0]
+		for _, project := range projects {
+			if project.IsDefault && b.cfg.ExcludeDefaultProjectGroup {
+				log.WithField("project", project.Name).Info("skipping default project")
+				continue
+			}
+			selected = append(selected, project)
+		}
+
+		var wanted map[int]string
+		if b.cfg.SkipExhaustedProjects {
+			wanted = dropletsByID
+		}
+		resourcesByProject, skipped, err := b.listProjectsResources(ctx, selected, b.cfg.ProjectConcurrency, wanted)
+		if err != nil {
+			return inv, stats, fmt.Errorf("couldn't list project resources: %w", err)
+		}
+		if b.cfg.SkipExhaustedProjects {
+			log.WithField("projects_skipped", skipped).Info("skipped listing the resources of projects without selected Droplets")
+		}
+
+		dropletsByProject = make(map[string][]string)
+		for _, project := range selected {
+			ll := log.WithField("project", project.Name)
+			for _, r := range resourcesByProject[project.ID] {
+				if !strings.HasPrefix(r.URN, "do:droplet:") {
+					continue
+				}
+
+				id := strings.TrimPrefix(r.URN, "do:droplet:")
+				idInt, err := strconv.Atoi(id)
+				if err != nil {
+					ll.WithError(err).WithField("urn", r.URN).Error("parsing droplet ID, skipping")
+					continue
+				}
+
+				// skip droplets that aren't included in the inventory
+				droplet, exists := dropletsByID[idInt]
+				if !exists {
+					continue
+				}
+
+				dropletsByProject[project.ID] = append(dropletsByProject[project.ID], droplet)
+			}
+		}
+
+		projectIDs := make([]string, 0, len(dropletsByProject))
+		for projectID := range dropletsByProject {
+			projectIDs = append(projectIDs, projectID)
+		}
+		sort.Slice(projectIDs, func(i, j int) bool {
+			return projectGroups[projectIDs[i]] < projectGroups[projectIDs[j]]
+		})
+
+		for _, projectID := range projectIDs {
+			project := projectGroups[projectID]
+			log.WithField("project", project).Info("building project group")
+
+			droplets := dropletsByProject[projectID]
+			sortHosts(droplets, hostIPs, groupSortKey)
+
+			g := inv.group(project)
+			g.kind = "project"
+			g.addHosts(droplets...)
+		}
+	}
+
+	// build the group of the Droplets that aren't in any tag or project group,
+	// once all of them are built
+	if b.cfg.EmitUngrouped {
+		grouped := make(map[string]bool, len(dropletsByID))
+		for _, hosts := range dropletsByTag {
+			for _, h := range hosts {
+				grouped[h] = true
+			}
+		}
+		for _, hosts := range dropletsByProject {
+			for _, h := range hosts {
+				grouped[h] = true
+			}
+		}
+
+		var ungrouped []string
+		for _, d := range droplets {
+			if name, ok := dropletsByID[d.ID]; ok && !grouped[name] {
+				ungrouped = append(ungrouped, name)
+			}
+		}
+		sortHosts(ungrouped, hostIPs, groupSortKey)
+
+		log.WithField("hosts", len(ungrouped)).Info("building ungrouped group")
+		inv.group("ungrouped").addHosts(ungrouped...)
+	}
+
+	// add the load balancers
+	if b.cfg.IncludeLoadBalancers {
+		log.Info("listing load balancers")
+		lbs, err := b.listLoadBalancers(ctx)
+		if err != nil {
+			return inv, stats, fmt.Errorf("couldn't list load balancers: %w", err)
+		}
+
+		var names []string
+		for _, lb := range lbs {
+			ll := log.WithField("load_balancer", lb.Name)
+			if aliases[lb.Name] {
+				ll.Warn("host name already used by a Droplet, skipped")
+				continue
+			}
+			aliases[lb.Name] = true
+
+			var vars []variable
+			if lb.IP != "" {
+				vars = append(vars, variable{"ansible_host", lb.IP})
+			} else {
+				ll.Warn("the load balancer has no IP address yet, using hostname")
+			}
+
+			h := inv.addHost(lb.Name, vars)
+			if lb.Region != nil {
+				h.region = lb.Region.Slug
+			}
+			names = append(names, lb.Name)
+		}
+
+		log.Info("building load balancer group")
+		inv.group("load_balancers").addHosts(names...)
+	}
+
+	// add the database clusters
+	if b.cfg.IncludeDatabases {
+		log.Info("listing databases")
+		dbs, err := b.listDatabases(ctx)
+		if err != nil {
+			return inv, stats, fmt.Errorf("couldn't list databases: %w", err)
+		}
+
+		var names []string
+		for _, db := range dbs {
+			ll := log.WithField("database", db.Name)
+			if aliases[db.Name] {
+				ll.Warn("host name already used, skipped")
+				continue
+			}
+			aliases[db.Name] = true
+
+			conn := db.Connection
+			if b.cfg.PrivateIPs && db.PrivateConnection != nil && db.PrivateConnection.Host != "" {
+				conn = db.PrivateConnection
+			}
+
+			var vars []variable
+			if conn != nil && conn.Host != "" {
+				vars = append(vars, variable{"ansible_host", conn.Host})
+			} else {
+				ll.Warn("the database has no connection details yet, using hostname")
+			}
+			vars = append(vars, variable{"do_db_engine", db.EngineSlug})
+			if conn != nil && conn.Port != 0 {
+				vars = append(vars, variable{"do_db_port", conn.Port})
+			}
+
+			h := inv.addHost(db.Name, vars)
+			h.region = db.RegionSlug
+			names = append(names, db.Name)
+		}
+
+		log.Info("building database group")
+		inv.group("databases").addHosts(names...)
+	}
+
+	// list every host in the all group, once they're all added
+	if b.cfg.EmitAllGroup {
+		log.Info("building all group")
+		all := inv.group("all")
+		for _, h := range inv.hosts {
+			all.addHosts(h.name)
+		}
+	}
+
+	return inv, stats, nil
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestBuild(t *testing.T) {
+	client := Client{
+		Droplets: &fakeDroplets{droplets: []godo.Droplet{
+			testDroplet(1, "web-01", "nyc3", "203.0.113.1", "web"),
+			testDroplet(2, "db-01", "sfo3", "203.0.113.2", "db"),
+			testDroplet(3, "web-02", "nyc3", "203.0.113.3", "web"),
+		}},
+	}
+	cfg := Config{
+		Ignore:        []string{"web-02"},
+		GroupByRegion: true,
+		Regions:       []string{},
+		GroupByTag:    true,
+		SSHUser:       "root",
+	}
+
+	inv, stats, err := Build(context.Background(), client, cfg)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if stats.DropletsListed != 3 || stats.DropletsIgnored != 1 {
+		t.Errorf("Build() listed %d and ignored %d Droplets, want 3 and 1", stats.DropletsListed, stats.DropletsIgnored)
+	}
+
+	rendered, err := inv.Render("ini")
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	want := `web-01 ansible_user=root ansible_host=203.0.113.1
+db-01 ansible_user=root ansible_host=203.0.113.2
+
+[nyc3]
+web-01
+
+[sfo3]
+db-01
+
+[db]
+db-01
+
+[web]
+web-01
+`
+	if got := rendered.String(); got != want {
+		t.Errorf("Render() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBuildResolveConcurrencyOrder(t *testing.T) {
+	// duplicate names and Droplets without an address make the output depend
+	// on the order the Droplets are handled in
+	var droplets []godo.Droplet
+	for i := 1; i <= 60; i++ {
+		ip := fmt.Sprintf("203.0.113.%d", i)
+		if i%7 == 0 {
+			ip = ""
+		}
+		droplets = append(droplets, testDroplet(i, fmt.Sprintf("web-%d", i%5), "nyc3", ip, "web"))
+	}
+
+	render := func(concurrency int) string {
+		client := Client{Droplets: &fakeDroplets{droplets: droplets}}
+		cfg := Config{GroupByTag: true, ResolveConcurrency: concurrency}
+		inv, _, err := Build(context.Background(), client, cfg)
+		if err != nil {
+			t.Fatalf("Build() error = %v", err)
+		}
+		rendered, err := inv.Render("ini")
+		if err != nil {
+			t.Fatalf("Render() error = %v", err)
+		}
+		return rendered.String()
+	}
+
+	want := render(1)
+	for run := 0; run < 20; run++ {
+		if got := render(16); got != want {
+			t.Fatalf("Render() with 16 concurrent lookups =\n%s\nwant\n%s", got, want)
+		}
+	}
+}
+
+func TestBuildSkipsLockedDroplets(t *testing.T) {
+	locked := testDroplet(2, "web-02", "nyc3", "203.0.113.2", "web")
+	locked.Locked = true
+	deleting := testDroplet(3, "web-03", "nyc3", "203.0.113.3", "web")
+	deleting.Status = "deleting"
+
+	client := Client{
+		Droplets: &fakeDroplets{droplets: []godo.Droplet{
+			testDroplet(1, "web-01", "nyc3", "203.0.113.1", "web"),
+			locked,
+			deleting,
+		}},
+	}
+
+	inv, stats, err := Build(context.Background(), client, Config{GroupByTag: true})
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if want := []string{"web-02", "web-03"}; !reflect.DeepEqual(stats.Skipped, want) {
+		t.Errorf("Build() skipped %v, want %v", stats.Skipped, want)
+	}
+
+	rendered, err := inv.Render("ini")
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	want := `web-01 ansible_host=203.0.113.1
+
+[web]
+web-01
+`
+	if got := rendered.String(); got != want {
+		t.Errorf("Render() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBuildTag(t *testing.T) {
+	client := Client{
+		Droplets: &fakeDroplets{droplets: []godo.Droplet{
+			testDroplet(1, "web-01", "nyc3", "203.0.113.1", "web"),
+			testDroplet(2, "db-01", "sfo3", "203.0.113.2", "db"),
+		}},
+	}
+
+	inv, stats, err := Build(context.Background(), client, Config{Tag: "db"})
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if stats.DropletsListed != 1 || inv.Hosts() != 1 {
+		t.Errorf("Build() listed %d Droplets and added %d hosts, want 1 and 1", stats.DropletsListed, inv.Hosts())
+	}
+}
+
+func TestBuildDropletIDsMissing(t *testing.T) {
+	client := Client{
+		Droplets: &fakeDroplets{droplets: []godo.Droplet{
+			testDroplet(1, "web-01", "nyc3", "203.0.113.1", "web"),
+			testDroplet(2, "db-01", "sfo3", "203.0.113.2", "db"),
+		}},
+	}
+
+	tests := []struct {
+		tag     string
+		wantErr string
+	}{
+		{"", "--droplet-id: Droplet IDs not found in the account: 3"},
+		// Droplet 2 exists, it just doesn't have the tag
+		{"web", "--droplet-id: Droplet IDs not matched by the current filters: 2, 3"},
+	}
+	for _, tt := range tests {
+		_, _, err := Build(context.Background(), client, Config{Tag: tt.tag, DropletIDs: []int{1, 2, 3}})
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("Build() with tag %q error = %v, want %q", tt.tag, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBuildProjectsSameName(t *testing.T) {
+	client := Client{
+		Droplets: &fakeDroplets{droplets: []godo.Droplet{
+			testDroplet(1, "web-01", "nyc3", "203.0.113.1"),
+			testDroplet(2, "web-02", "nyc3", "203.0.113.2"),
+		}},
+		Projects: &fakeProjects{
+			projects: []godo.Project{
+				{ID: "4e1f0a9c-aaaa", Name: "Shop"},
+				{ID: "7b2d3e8f-bbbb", Name: "Shop"},
+			},
+			resources: map[string][]godo.ProjectResource{
+				"4e1f0a9c-aaaa": {{URN: "do:droplet:1"}},
+				"7b2d3e8f-bbbb": {{URN: "do:droplet:2"}},
+			},
+		},
+	}
+
+	inv, _, err := Build(context.Background(), client, Config{GroupByProject: true})
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	rendered, err := inv.Render("ini")
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	want := `web-01 ansible_host=203.0.113.1
+web-02 ansible_host=203.0.113.2
+
+[Shop_4e1f0a9c]
+web-01
+
+[Shop_7b2d3e8f]
+web-02
+`
+	if got := rendered.String(); got != want {
+		t.Errorf("Render() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBuildSortHostsByIP(t *testing.T) {
+	client := Client{
+		Droplets: &fakeDroplets{droplets: []godo.Droplet{
+			testDroplet(1, "web", "nyc3", "203.0.113.9"),
+			testDroplet(2, "web", "nyc3", "203.0.113.10"),
+			testDroplet(3, "db", "nyc3", "203.0.113.1"),
+		}},
+	}
+
+	inv, _, err := Build(context.Background(), client, Config{SortHostsBy: "ip", GroupByRegion: true, Regions: []string{}})
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	rendered, err := inv.Render("ini")
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	// the first Droplet in the API's order keeps the duplicate name
+	want := `db ansible_host=203.0.113.1
+web ansible_host=203.0.113.9
+web-2 ansible_host=203.0.113.10
+
+[nyc3]
+db
+web
+web-2
+`
+	if got := rendered.String(); got != want {
+		t.Errorf("Render() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBuildVPCsSameName(t *testing.T) {
+	droplets := []godo.Droplet{
+		testDroplet(1, "web-nyc", "nyc3", "203.0.113.1"),
+		testDroplet(2, "web-sfo", "sfo3", "203.0.113.2"),
+		testDroplet(3, "db", "nyc3", "203.0.113.3"),
+	}
+	droplets[0].VPCUUID = "5a4981aa-aaaa"
+	droplets[1].VPCUUID = "9c1d2e3f-bbbb"
+	droplets[2].VPCUUID = "0b7e6d5c-cccc"
+
+	client := Client{
+		Droplets: &fakeDroplets{droplets: droplets},
+		VPCs: &fakeVPCs{vpcs: map[string]*godo.VPC{
+			"5a4981aa-aaaa": {ID: "5a4981aa-aaaa", Name: "main", RegionSlug: "nyc3"},
+			"9c1d2e3f-bbbb": {ID: "9c1d2e3f-bbbb", Name: "main", RegionSlug: "sfo3"},
+			"0b7e6d5c-cccc": {ID: "0b7e6d5c-cccc", Name: "backend", RegionSlug: "nyc3"},
+		}},
+	}
+
+	inv, _, err := Build(context.Background(), client, Config{GroupByVPC: true, Regions: []string{}})
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	want := map[string][]string{
+		"vpc_main_nyc3": {"web-nyc"},
+		"vpc_main_sfo3": {"web-sfo"},
+		"vpc_backend":   {"db"},
+	}
+	for group, hosts := range want {
+		g, ok := inv.groupsByName[group]
+		if !ok {
+			t.Errorf("group %q is missing", group)
+			continue
+		}
+		if !reflect.DeepEqual(g.hosts, hosts) {
+			t.Errorf("group %q hosts = %v, want %v", group, g.hosts, hosts)
+		}
+	}
+	if _, ok := inv.groupsByName["vpc_main"]; ok {
+		t.Errorf("VPCs sharing a name were merged into vpc_main")
+	}
+}
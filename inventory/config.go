@@ -0,0 +1,276 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultRegions are the regions that get a group even if they have no
+// Droplets, unless Config.Regions is set
+var DefaultRegions = []string{"ams1", "ams2", "ams3", "blr1", "fra1", "lon1", "nyc1", "nyc2", "nyc3", "sfo1", "sfo2", "sfo3", "sgp1", "syd1", "tor1"}
+
+// Config holds the options of an inventory build. The zero value lists every
+// Droplet without grouping them.
+type Config struct {
+	// connection vars
+	SSHUser                    string
+	SSHPort                    int
+	ConnectionVarsAtGroupLevel bool
+	// SSHUserForTag, SSHKeyFileForTag, and SSHExtraArgsFor map tags to values
+	// in the form tag=value
+	SSHUserForTag     []string
+	SSHKeyFile        string
+	SSHKeyFileForTag  []string
+	SSHExtraArgsFor   []string
+	PythonInterpreter string
+	Bastion           string
+	BastionTag        string
+	// InsecureHostKeys disables host key checking on every host, and
+	// InsecureHostKeysTags on the Droplets with one of the tags
+	InsecureHostKeys     bool
+	InsecureHostKeysTags []string
+
+	// addresses
+	PrivateIPs bool
+	// IPFamilies is the order of the address families tried for
+	// ansible_host, ipv4 and ipv6. Defaults to ipv4.
+	IPFamilies []string
+	// HostOverrides force ansible_host, in the form name=address
+	HostOverrides []string
+	FQDNDomain    string
+	UseFQDN       bool
+	// PreferReservedIP uses the reserved IP assigned to a Droplet as
+	// ansible_host, unless it has a host override
+	PreferReservedIP bool
+	// PreferCIDR picks the Droplet's IPv4 address in this network, e.g. the
+	// range of one of several VPCs, falling back to the other options if it
+	// has none
+	PreferCIDR string
+
+	// selection
+	Tag           string
+	TagsUnion     []string
+	TagRequireAll []string
+	TagRequireAny []string
+	Statuses      []string
+	// IncludeRegions only includes the Droplets in these regions, if it's not
+	// empty, and ExcludeRegions leaves out the Droplets in these regions
+	IncludeRegions []string
+	ExcludeRegions []string
+	// ChangedSince only includes Droplets created since, if it's not zero
+	ChangedSince time.Time
+	// CreatedAfter and CreatedBefore only include Droplets created in the
+	// window between them, if they're not zero
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// NameMatch only includes the Droplets whose name matches one of these
+	// shell-style globs, and NamePrefix the ones whose name starts with it,
+	// if they're set. IgnoreCase makes both, and Ignore, case-insensitive.
+	NameMatch  []string
+	NamePrefix string
+	IgnoreCase bool
+	// DropletIDs only includes the Droplets with these IDs, if it's not
+	// empty. Unlike IncludeIDs, an ID that isn't listed is an error.
+	DropletIDs []int
+	// IncludeIDs only includes the Droplets with these IDs, if it's not nil
+	IncludeIDs      []int
+	Ignore          []string
+	IgnoreTags      []string
+	IgnoreRegex     []string
+	ExcludeWhere    []string
+	GPUOnly         bool
+	GPUSizePrefixes []string
+
+	// host names and vars
+	HostAliasFrom    string
+	Dedupe           string
+	SortHostsBy      string
+	HostVars         bool
+	FeaturesAsVar    bool
+	TagsAsVar        bool
+	IncludeBackupIDs bool
+	IncludePanelURL  bool
+	// TagVars sets a do_tag_<key>=<value> host var for every tag made of a
+	// key and a value joined by TagVarsSeparator
+	TagVars          bool
+	TagVarsSeparator string
+
+	// IncludeLoadBalancers adds the load balancers as hosts of a
+	// load_balancers group
+	IncludeLoadBalancers bool
+	// IncludeDatabases adds the managed database clusters as hosts of a
+	// databases group
+	IncludeDatabases bool
+
+	// groups
+	GroupByRegion bool
+	// Regions get a group even if they have no Droplets, defaults to
+	// DefaultRegions
+	Regions    []string
+	RegionVars bool
+	// RegionParent and TagParent are groups the region and tag groups are
+	// made children of, if they're set
+	RegionParent string
+	TagParent    string
+	// RegionPrefix, TagPrefix, and ProjectPrefix are prepended to the names
+	// of the region, tag, and project groups before they're sanitized
+	RegionPrefix               string
+	TagPrefix                  string
+	ProjectPrefix              string
+	GroupByTag                 bool
+	HierarchicalTags           bool
+	GroupByProject             bool
+	ExcludeDefaultProjectGroup bool
+	GroupByGPU                 bool
+	GroupByImage               bool
+	GroupByFeature             bool
+	GroupByVPC                 bool
+	GroupByNamePrefix          bool
+	NamePrefixDelimiter        string
+	GroupByPrivateSubnet       bool
+	PrivateSubnetMask          int
+	GroupByLifecycle           bool
+	LifecycleNewAge            time.Duration
+	GroupByVCPUs               bool
+	GroupByMemory              bool
+	// MemoryBuckets are name=MB tiers, e.g. small=2048, that GroupByMemory
+	// groups Droplets into instead of by their exact memory
+	MemoryBuckets []string
+	// EmitUngrouped adds the Droplets that aren't in any tag or project
+	// group to an ungrouped group
+	EmitUngrouped bool
+	// EmitAllGroup lists every host in an explicit all group at the top of
+	// the inventory
+	EmitAllGroup bool
+
+	// API usage
+	BackupLookupConcurrency int
+	// ResolveConcurrency is the number of Droplets whose host alias and
+	// address are looked up at once
+	ResolveConcurrency int
+	ProjectConcurrency int
+	// SkipExhaustedProjects stops listing project resources once the
+	// project of every selected Droplet is known
+	SkipExhaustedProjects bool
+	MaxRetries            int
+	// RetryBaseDelay is the wait before the first retry of a request that
+	// failed with a server or network error, doubling for every retry.
+	// Defaults to a second.
+	RetryBaseDelay time.Duration
+	// RequestTimeout bounds every API request, within the deadline of the
+	// context Build is called with, if it's set
+	RequestTimeout time.Duration
+	// PerPage is the number of items requested per page of the API listings,
+	// up to MaxPerPage. The API's default is used if it's 0.
+	PerPage int
+}
+
+// MaxPerPage is the largest page size the DigitalOcean API accepts
+const MaxPerPage = 200
+
+// Validate checks the options that can't be checked while they're parsed
+func (c *Config) Validate() error {
+	if len(c.TagsUnion) > 0 && c.Tag != "" {
+		return errors.New("--tags-union and --tag can't be used together")
+	}
+	if c.UseFQDN && c.FQDNDomain == "" {
+		return errors.New("--use-fqdn requires --fqdn-domain")
+	}
+	if err := validateHostAliasFrom(c.HostAliasFrom); err != nil {
+		return fmt.Errorf("--host-alias-from: %w", err)
+	}
+	switch c.Dedupe {
+	case "", "id", "skip", "error":
+	default:
+		return fmt.Errorf("--dedupe: unknown strategy %q, expected id, skip or error", c.Dedupe)
+	}
+	for _, f := range c.IPFamilies {
+		if f != "ipv4" && f != "ipv6" {
+			return fmt.Errorf("--ip-preference: unknown address family %q, expected ipv4 or ipv6", f)
+		}
+	}
+	if c.GroupByNamePrefix && c.NamePrefixDelimiter == "" {
+		return errors.New("--name-prefix-delimiter can't be empty")
+	}
+	if c.GroupByPrivateSubnet && (c.PrivateSubnetMask < 0 || c.PrivateSubnetMask > 32) {
+		return fmt.Errorf("--private-subnet-mask must be between 0 and 32, got %d", c.PrivateSubnetMask)
+	}
+	if !c.CreatedAfter.IsZero() && !c.CreatedBefore.IsZero() && !c.CreatedAfter.Before(c.CreatedBefore) {
+		return errors.New("--created-after must be before --created-before")
+	}
+	for _, pattern := range c.NameMatch {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("--name-match: invalid pattern %q: %w", pattern, err)
+		}
+	}
+	if c.TagVars && c.TagVarsSeparator == "" {
+		return errors.New("--tag-vars-separator can't be empty")
+	}
+	if len(c.MemoryBuckets) > 0 && !c.GroupByMemory {
+		return errors.New("--memory-buckets requires --group-by-memory")
+	}
+	if c.PerPage < 0 {
+		return fmt.Errorf("--per-page can't be negative, got %d", c.PerPage)
+	}
+
+	return nil
+}
+
+// validateHostAliasFrom checks the value of --host-alias-from
+func validateHostAliasFrom(from string) error {
+	switch from {
+	case "", "name", "id", "private-ip":
+		return nil
+	}
+	if key := strings.TrimPrefix(from, "tag:"); key != from && key != "" {
+		return nil
+	}
+
+	return fmt.Errorf("unknown host alias %q, expected name, id, private-ip or tag:<key>", from)
+}
+
+// compileIgnoreRegex compiles the --ignore-regex patterns
+func compileIgnoreRegex(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("--ignore-regex: %w", err)
+		}
+		compiled = append(compiled, re)
+	}
+
+	return compiled, nil
+}
+
+// SplitList splits a comma-separated option value, dropping empty items
+func SplitList(s string) []string {
+	var items []string
+	for _, i := range strings.Split(s, ",") {
+		i = strings.TrimSpace(i)
+		if i == "" {
+			continue
+		}
+
+		items = append(items, i)
+	}
+
+	return items
+}
@@ -0,0 +1,1020 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/digitalocean/godo"
+)
+
+// tagHierarchy returns the sorted child groups of each level of the tags that
+// contain a colon. team:payments:api produces team -> team_payments and
+// team_payments -> team_payments_api, the latter being the tag's own group.
+// Every group name starts with prefix. Tags with an empty level, such as
+// team::api, aren't nested, since dropping the level would merge them into the
+// hierarchy of another tag, team:api, they only keep their own flat group.
+func tagHierarchy(dropletsByTag map[string][]string, prefix string) map[string][]string {
+	children := map[string]map[string]struct{}{}
+	for tag := range dropletsByTag {
+		levels := strings.Split(tag, ":")
+		if len(levels) > 1 && hasEmpty(levels) {
+			log.WithField("tag", tag).Warn("tag has an empty level, not nesting it")
+			continue
+		}
+
+		for i := 1; i < len(levels); i++ {
+			parent := sanitizeAnsibleGroup(prefix + strings.Join(levels[:i], "_"))
+			child := sanitizeAnsibleGroup(prefix + strings.Join(levels[:i+1], "_"))
+
+			if children[parent] == nil {
+				children[parent] = map[string]struct{}{}
+			}
+			children[parent][child] = struct{}{}
+		}
+	}
+
+	sorted := make(map[string][]string, len(children))
+	for parent, cc := range children {
+		for child := range cc {
+			sorted[parent] = append(sorted[parent], child)
+		}
+		sort.Strings(sorted[parent])
+	}
+
+	return sorted
+}
+
+// hasEmpty reports whether any of the strings is empty
+func hasEmpty(ss []string) bool {
+	for _, s := range ss {
+		if s == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// projectGroupNames returns the group name of each project keyed by project
+// ID. Projects whose sanitized names collide are disambiguated by appending
+// the first 8 characters of their ID. Every group name starts with prefix.
+func projectGroupNames(projects []godo.Project, prefix string) map[string]string {
+	counts := make(map[string]int, len(projects))
+	for _, p := range projects {
+		counts[sanitizeAnsibleGroup(prefix+p.Name)]++
+	}
+
+	names := make(map[string]string, len(projects))
+	for _, p := range projects {
+		name := sanitizeAnsibleGroup(prefix + p.Name)
+		if counts[name] > 1 {
+			shortID := p.ID
+			if len(shortID) > 8 {
+				shortID = shortID[:8]
+			}
+
+			name = sanitizeAnsibleGroup(prefix + p.Name + "_" + shortID)
+			log.WithField("project", p.Name).WithField("group", name).Warn("multiple projects share this name, disambiguating with the project ID")
+		}
+
+		names[p.ID] = name
+	}
+
+	return names
+}
+
+func sanitizeAnsibleGroup(s string) string {
+	// empty tag and project names would otherwise make an empty group name
+	if s == "" {
+		return "_empty"
+	}
+
+	// replace invalid characters, group names can only contain letters,
+	// digits, and underscores
+	s = strings.Map(func(r rune) rune {
+		if r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+
+	// group names cannot start with a digit
+	if '0' <= s[0] && s[0] <= '9' {
+		s = "_" + s
+	}
+
+	return s
+}
+
+// hasAnyTag returns the first of the Droplet's tags that's in tags
+func hasAnyTag(d godo.Droplet, tags map[string]interface{}) (string, bool) {
+	for _, t := range d.Tags {
+		if _, ok := tags[t]; ok {
+			return t, true
+		}
+	}
+
+	return "", false
+}
+
+// matchesAny returns the first of the patterns that matches s
+func matchesAny(s string, patterns []*regexp.Regexp) (*regexp.Regexp, bool) {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return re, true
+		}
+	}
+
+	return nil, false
+}
+
+// removeIgnored removes the Droplets named in ignored, compared
+// case-insensitively if ignoreCase is set, tagged with one of ignoredTags, or
+// whose name matches one of the patterns. Ignored names, tags, and patterns
+// that match no Droplet are logged, they're likely typos or the Droplets they
+// were meant for are gone.
+func removeIgnored(droplets []godo.Droplet, ignored []string, ignoreCase bool, ignoredTags []string, patterns []*regexp.Regexp) []godo.Droplet {
+	if len(ignored) == 0 && len(ignoredTags) == 0 && len(patterns) == 0 {
+		return droplets
+	}
+
+	normalize := func(name string) string {
+		if ignoreCase {
+			return strings.ToLower(name)
+		}
+		return name
+	}
+
+	// copy ignored droplets into a map, tracking whether they matched
+	ignoreList := make(map[string]bool, len(ignored))
+	for _, i := range ignored {
+		ignoreList[normalize(i)] = false
+	}
+
+	ignoreTags := make(map[string]interface{}, len(ignoredTags))
+	tagsMatched := make(map[string]bool, len(ignoredTags))
+	for _, t := range ignoredTags {
+		ignoreTags[t] = struct{}{}
+		tagsMatched[t] = false
+	}
+
+	patternsMatched := make([]bool, len(patterns))
+
+	// remove ignored droplets from the list
+	newDroplets := droplets[:0]
+	for _, d := range droplets {
+		// track every entry the Droplet matches, not only the one it's
+		// ignored by
+		if _, ok := ignoreList[normalize(d.Name)]; ok {
+			ignoreList[normalize(d.Name)] = true
+		}
+		for _, t := range d.Tags {
+			if _, ok := tagsMatched[t]; ok {
+				tagsMatched[t] = true
+			}
+		}
+		for i, re := range patterns {
+			if re.MatchString(d.Name) {
+				patternsMatched[i] = true
+			}
+		}
+
+		if _, ignored := ignoreList[normalize(d.Name)]; ignored {
+			log.WithField("droplet", d.Name).Info("ignoring")
+			continue
+		}
+
+		if t, ignored := hasAnyTag(d, ignoreTags); ignored {
+			log.WithField("droplet", d.Name).WithField("tag", t).Info("ignoring")
+			continue
+		}
+
+		if re, ignored := matchesAny(d.Name, patterns); ignored {
+			log.WithField("droplet", d.Name).WithField("pattern", re).Info("ignoring")
+			continue
+		}
+
+		newDroplets = append(newDroplets, d)
+	}
+
+	for _, i := range ignored {
+		if !ignoreList[normalize(i)] {
+			log.WithField("droplet", i).Warn("ignored name didn't match any Droplet")
+		}
+	}
+	for _, t := range ignoredTags {
+		if !tagsMatched[t] {
+			log.WithField("tag", t).Warn("ignored tag didn't match any Droplet")
+		}
+	}
+	for i, re := range patterns {
+		if !patternsMatched[i] {
+			log.WithField("pattern", re).Warn("ignored pattern didn't match any Droplet")
+		}
+	}
+
+	return newDroplets
+}
+
+// filterTags keeps the Droplets that have every tag in allOf and, if anyOf is
+// not empty, at least one of the tags in anyOf
+func filterTags(droplets []godo.Droplet, allOf, anyOf []string) []godo.Droplet {
+	newDroplets := droplets[:0]
+	for _, d := range droplets {
+		tags := make(map[string]struct{}, len(d.Tags))
+		for _, t := range d.Tags {
+			tags[t] = struct{}{}
+		}
+
+		matchesAll := true
+		for _, t := range allOf {
+			if _, ok := tags[t]; !ok {
+				matchesAll = false
+				break
+			}
+		}
+
+		matchesAny := len(anyOf) == 0
+		for _, t := range anyOf {
+			if _, ok := tags[t]; ok {
+				matchesAny = true
+				break
+			}
+		}
+
+		if !matchesAll || !matchesAny {
+			log.WithField("droplet", d.Name).Info("missing required tags, ignoring")
+			continue
+		}
+
+		newDroplets = append(newDroplets, d)
+	}
+
+	return newDroplets
+}
+
+// keyValue is a key=value pair passed to a flag
+type keyValue struct {
+	key   string
+	value string
+}
+
+// parseKeyValues parses key=value flag values, splitting on the first =
+func parseKeyValues(values []string) ([]keyValue, error) {
+	kvs := make([]keyValue, 0, len(values))
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not in the form key=value", v)
+		}
+
+		kvs = append(kvs, keyValue{key: parts[0], value: parts[1]})
+	}
+
+	return kvs, nil
+}
+
+// tagValues returns the values of the mappings whose key is one of the
+// Droplet's tags, in the order they were passed
+func tagValues(d godo.Droplet, mappings []keyValue) []string {
+	var values []string
+	for _, m := range mappings {
+		for _, t := range d.Tags {
+			if t == m.key {
+				values = append(values, m.value)
+				break
+			}
+		}
+	}
+
+	return values
+}
+
+// tagsList returns the Droplet's tags, an empty list rather than nil so
+// Droplets without tags still get an empty do_tags list
+func tagsList(d godo.Droplet) []string {
+	if d.Tags == nil {
+		return []string{}
+	}
+	return d.Tags
+}
+
+// tagVars returns a do_tag_<key>=<value> var for each of the Droplet's tags
+// containing sep, split at its first occurrence, e.g. do_tag_env=prod for
+// env:prod. If several tags have the same key, the first one is used.
+func tagVars(d godo.Droplet, sep string) []variable {
+	var vars []variable
+	seen := map[string]bool{}
+	for _, t := range d.Tags {
+		kv := strings.SplitN(t, sep, 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		key := "do_tag_" + sanitizeAnsibleGroup(kv[0])
+		if seen[key] {
+			log.WithField("droplet", d.Name).WithField("tag", t).Warnf("%s is already set by another tag, skipping", key)
+			continue
+		}
+		seen[key] = true
+
+		vars = append(vars, variable{key, kv[1]})
+	}
+
+	return vars
+}
+
+// filterStatus keeps the Droplets with one of the statuses
+func filterStatus(droplets []godo.Droplet, statuses []string) []godo.Droplet {
+	selected := make(map[string]struct{}, len(statuses))
+	for _, s := range statuses {
+		selected[s] = struct{}{}
+	}
+
+	newDroplets := droplets[:0]
+	for _, d := range droplets {
+		if _, ok := selected[d.Status]; !ok {
+			log.WithField("droplet", d.Name).WithField("status", d.Status).Info("status not selected, ignoring")
+			continue
+		}
+
+		newDroplets = append(newDroplets, d)
+	}
+
+	return newDroplets
+}
+
+// filterRegions keeps the Droplets in one of the included regions, if any
+// are given, and not in one of the excluded regions
+func filterRegions(droplets []godo.Droplet, include, exclude []string) []godo.Droplet {
+	included := make(map[string]bool, len(include))
+	for _, r := range include {
+		included[r] = true
+	}
+	excluded := make(map[string]bool, len(exclude))
+	for _, r := range exclude {
+		excluded[r] = true
+	}
+
+	newDroplets := droplets[:0]
+	for _, d := range droplets {
+		region := ""
+		if d.Region != nil {
+			region = d.Region.Slug
+		}
+		if (len(included) > 0 && !included[region]) || excluded[region] {
+			log.WithField("droplet", d.Name).WithField("region", region).Info("region not selected, ignoring")
+			continue
+		}
+
+		newDroplets = append(newDroplets, d)
+	}
+
+	return newDroplets
+}
+
+// warnUnknownRegions warns about the regions that aren't DigitalOcean
+// regions, they're likely typos
+func warnUnknownRegions(regions []string) {
+	known := make(map[string]bool, len(DefaultRegions))
+	for _, r := range DefaultRegions {
+		known[r] = true
+	}
+
+	for _, r := range regions {
+		if !known[r] {
+			log.WithField("region", r).Warn("unknown region")
+		}
+	}
+}
+
+// filterNames keeps the Droplets whose name matches one of the globs, if
+// there are any, and starts with prefix. The patterns were checked by
+// Validate.
+func filterNames(droplets []godo.Droplet, globs []string, prefix string, ignoreCase bool) []godo.Droplet {
+	if ignoreCase {
+		prefix = strings.ToLower(prefix)
+	}
+
+	newDroplets := droplets[:0]
+	for _, d := range droplets {
+		name := d.Name
+		if ignoreCase {
+			name = strings.ToLower(name)
+		}
+
+		if !strings.HasPrefix(name, prefix) {
+			log.WithField("droplet", d.Name).Debug("name doesn't start with --name-prefix, ignoring")
+			continue
+		}
+
+		matched := len(globs) == 0
+		for _, glob := range globs {
+			if ignoreCase {
+				glob = strings.ToLower(glob)
+			}
+			if ok, _ := path.Match(glob, name); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			log.WithField("droplet", d.Name).Debug("name doesn't match --name-match, ignoring")
+			continue
+		}
+
+		newDroplets = append(newDroplets, d)
+	}
+
+	return newDroplets
+}
+
+// filterIDs keeps the Droplets whose IDs are in ids
+func filterIDs(droplets []godo.Droplet, ids []int) []godo.Droplet {
+	included := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		included[id] = true
+	}
+
+	newDroplets := droplets[:0]
+	for _, d := range droplets {
+		if !included[d.ID] {
+			log.WithField("droplet", d.Name).Info("not included by ID, ignoring")
+			continue
+		}
+
+		newDroplets = append(newDroplets, d)
+	}
+
+	return newDroplets
+}
+
+// missingIDs returns the ids that none of the Droplets has
+func missingIDs(droplets []godo.Droplet, ids []int) []string {
+	listed := make(map[int]bool, len(droplets))
+	for _, d := range droplets {
+		listed[d.ID] = true
+	}
+
+	var missing []string
+	for _, id := range ids {
+		if !listed[id] {
+			missing = append(missing, strconv.Itoa(id))
+		}
+	}
+
+	return missing
+}
+
+// resolved is the host alias and address of a Droplet
+type resolved struct {
+	alias    string
+	aliasErr error
+	ip       string
+	ipErr    error
+}
+
+// resolveDroplets looks up the host alias and address of every Droplet,
+// running up to concurrency lookups at once. The results are in the order of
+// droplets, so the Droplets can then be added to the inventory and its groups
+// one by one and the output, including which Droplet keeps a duplicate name,
+// stays deterministic.
+func (b *builder) resolveDroplets(droplets []godo.Droplet, concurrency int) []resolved {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, concurrency)
+		results = make([]resolved, len(droplets))
+	)
+	for i, d := range droplets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *resolved, d godo.Droplet) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// each goroutine only writes its own result
+			r.alias, r.aliasErr = hostAlias(d, b.cfg.HostAliasFrom)
+			r.ip, r.ipErr = b.dropletIP(d)
+		}(&results[i], d)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// parseIPOverrides parses the name=address host overrides, later overrides of
+// a name taking precedence
+func parseIPOverrides(values []string) (map[string]string, error) {
+	kvs, err := parseKeyValues(values)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		overrides[kv.key] = kv.value
+	}
+
+	return overrides, nil
+}
+
+// warnUnusedOverrides warns about overrides for Droplets that aren't in the
+// inventory
+func warnUnusedOverrides(droplets []godo.Droplet, overrides map[string]string) {
+	names := make(map[string]bool, len(droplets))
+	for _, d := range droplets {
+		names[d.Name] = true
+	}
+
+	for name := range overrides {
+		if !names[name] {
+			log.WithField("droplet", name).Warn("host override doesn't match any Droplet")
+		}
+	}
+}
+
+// filterCreated keeps the Droplets created at or after after and before
+// before. Zero times leave that end of the window open. It also selects the
+// Droplets changed since a time, since the API only exposes a Droplet's
+// creation time.
+func filterCreated(droplets []godo.Droplet, after, before time.Time) []godo.Droplet {
+	newDroplets := droplets[:0]
+	for _, d := range droplets {
+		ll := log.WithField("droplet", d.Name)
+
+		created, err := time.Parse(time.RFC3339, d.Created)
+		if err != nil {
+			ll.WithError(err).Error("couldn't parse the Droplet's creation time, ignoring")
+			continue
+		}
+
+		if !after.IsZero() && created.Before(after) {
+			ll.Debug("created before the date window, ignoring")
+			continue
+		}
+		if !before.IsZero() && !created.Before(before) {
+			ll.Debug("created after the date window, ignoring")
+			continue
+		}
+
+		newDroplets = append(newDroplets, d)
+	}
+
+	return newDroplets
+}
+
+// dropletIP returns the Droplet's --host-override address if it has one, and
+// otherwise its first address in the --ip-preference order. IPv4 addresses
+// are public or private depending on --private-ips.
+func (b *builder) dropletIP(d godo.Droplet) (string, error) {
+	if ip, ok := b.ipOverrides[d.Name]; ok {
+		return ip, nil
+	}
+
+	if b.preferNetwork != nil {
+		if ip := networkAddress(d, b.preferNetwork); ip != "" {
+			return ip, nil
+		}
+	}
+
+	for _, family := range b.cfg.IPFamilies {
+		var (
+			ip  string
+			err error
+		)
+		switch {
+		case family == "ipv6":
+			ip, err = d.PublicIPv6()
+		case b.cfg.PrivateIPs:
+			ip, err = d.PrivateIPv4()
+		default:
+			ip, err = d.PublicIPv4()
+		}
+		if err != nil || ip != "" {
+			return ip, err
+		}
+	}
+
+	return "", nil
+}
+
+// networkAddress returns the first of the Droplet's IPv4 addresses that's in
+// network, or an empty string if there's none
+func networkAddress(d godo.Droplet, network *net.IPNet) string {
+	if d.Networks == nil {
+		return ""
+	}
+
+	for _, v4 := range d.Networks.V4 {
+		if ip := net.ParseIP(v4.IPAddress); ip != nil && network.Contains(ip) {
+			return v4.IPAddress
+		}
+	}
+
+	return ""
+}
+
+// hostAlias returns the inventory host name of the Droplet according to
+// --host-alias-from
+func hostAlias(d godo.Droplet, from string) (string, error) {
+	switch from {
+	case "name":
+		return d.Name, nil
+	case "id":
+		return strconv.Itoa(d.ID), nil
+	case "private-ip":
+		ip, err := d.PrivateIPv4()
+		if err != nil {
+			return "", err
+		}
+		if ip == "" {
+			return "", errors.New("Droplet has no private IP address")
+		}
+		return ip, nil
+	}
+
+	key := strings.TrimPrefix(from, "tag:")
+	for _, t := range d.Tags {
+		if strings.HasPrefix(t, key+":") && len(t) > len(key)+1 {
+			return t[len(key)+1:], nil
+		}
+	}
+
+	return "", fmt.Errorf("Droplet has no %s:<value> tag", key)
+}
+
+// bastionAddress returns the public IPv4 address of the Droplet named bastion,
+// or bastion itself if there's no such Droplet
+func bastionAddress(droplets []godo.Droplet, bastion string) string {
+	for _, d := range droplets {
+		if d.Name != bastion {
+			continue
+		}
+
+		ip, err := d.PublicIPv4()
+		if err == nil && ip != "" {
+			return ip
+		}
+	}
+
+	return bastion
+}
+
+// isBastion reports whether the Droplet is the bastion, by --bastion name or
+// --bastion-tag
+func isBastion(d godo.Droplet, bastion, tag string) bool {
+	if d.Name == bastion {
+		return true
+	}
+	if tag == "" {
+		return false
+	}
+
+	for _, t := range d.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dropletFQDN returns the Droplet's name qualified with domain. Names that are
+// already in the domain, or end with a dot, are used as they are.
+func dropletFQDN(name, domain string) string {
+	domain = strings.Trim(domain, ".")
+	if strings.HasSuffix(name, ".") {
+		return strings.TrimSuffix(name, ".")
+	}
+	if name == domain || strings.HasSuffix(name, "."+domain) {
+		return name
+	}
+
+	return name + "." + domain
+}
+
+// sortHosts orders a group's host names by name or by their IP address
+func sortHosts(hosts []string, ips map[string]string, key string) {
+	sort.SliceStable(hosts, func(i, j int) bool {
+		a, b := hosts[i], hosts[j]
+		return hostLess(key, a, ips[a], b, ips[b])
+	})
+}
+
+// hostLess reports whether host a sorts before host b. When sorting by ip,
+// addresses are compared numerically (IPv4 before IPv6) and hosts without an
+// IP fall back to being sorted by name after all hosts that have one.
+func hostLess(key, nameA, ipA, nameB, ipB string) bool {
+	if key == "ip" {
+		a, b := net.ParseIP(ipA), net.ParseIP(ipB)
+		switch {
+		case a != nil && b == nil:
+			return true
+		case a == nil && b != nil:
+			return false
+		case a != nil && b != nil:
+			if c := bytes.Compare(a.To16(), b.To16()); c != 0 {
+				return c < 0
+			}
+		}
+	}
+
+	return nameA < nameB
+}
+
+// dropletPythonInterpreter returns the ansible_python_interpreter of the
+// Droplet for --python-interpreter. auto picks /usr/bin/python3 for images of
+// distributions that don't ship /usr/bin/python anymore, and nothing for others.
+func dropletPythonInterpreter(d godo.Droplet, interpreter string) string {
+	if interpreter != "auto" {
+		return interpreter
+	}
+	if d.Image == nil {
+		return ""
+	}
+
+	// python3 is the only python since Ubuntu 20.04 and Debian 10
+	minVersions := map[string]int{"ubuntu": 20, "debian": 10}
+	distribution := strings.ToLower(d.Image.Distribution)
+	version := imageMajorVersion(d.Image)
+	if minVersion, ok := minVersions[distribution]; ok && version >= minVersion {
+		return "/usr/bin/python3"
+	}
+
+	return ""
+}
+
+// imageMajorVersion returns the major version of the image's distribution,
+// taken from its slug (ubuntu-20-04-x64) or name (20.04 (LTS) x64), or 0 if
+// it's unknown
+func imageMajorVersion(image *godo.Image) int {
+	if parts := strings.Split(image.Slug, "-"); len(parts) > 1 {
+		if v, err := strconv.Atoi(parts[1]); err == nil {
+			return v
+		}
+	}
+
+	name := strings.SplitN(image.Name, ".", 2)[0]
+	if v, err := strconv.Atoi(name); err == nil {
+		return v
+	}
+
+	return 0
+}
+
+// imageGroup returns the group name of the Droplet's image slug, or of its
+// distribution for images without a slug such as custom images and snapshots
+func imageGroup(d godo.Droplet) string {
+	if d.Image == nil {
+		return ""
+	}
+
+	image := d.Image.Slug
+	if image == "" {
+		image = d.Image.Distribution
+	}
+	if image == "" {
+		return ""
+	}
+
+	return sanitizeAnsibleGroup(image)
+}
+
+// lifecycleGroup returns the lifecycle group of the Droplet: lifecycle_new for
+// Droplets that are still being created or were created less than newAge
+// before now, lifecycle_active for the other active Droplets and lifecycle_off
+// for Droplets that are off or archived. Locked Droplets, e.g. while they're
+// being migrated, and Droplets in any other state have no group and are skipped.
+func lifecycleGroup(d godo.Droplet, newAge time.Duration, now time.Time) string {
+	if d.Locked {
+		return ""
+	}
+
+	switch d.Status {
+	case "new":
+		return "lifecycle_new"
+	case "active":
+		created, err := time.Parse(time.RFC3339, d.Created)
+		if err == nil && now.Sub(created) < newAge {
+			return "lifecycle_new"
+		}
+		return "lifecycle_active"
+	case "off", "archive":
+		return "lifecycle_off"
+	}
+
+	return ""
+}
+
+// memoryBucket is a --memory-buckets tier, for Droplets with up to limit MB of
+// memory
+type memoryBucket struct {
+	group string
+	limit int
+}
+
+// parseMemoryBuckets parses name=MB memory tiers such as small=2048, sorted
+// by their limit
+func parseMemoryBuckets(values []string) ([]memoryBucket, error) {
+	kvs, err := parseKeyValues(values)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]memoryBucket, 0, len(kvs))
+	seen := make(map[string]bool, len(kvs))
+	for _, kv := range kvs {
+		limit, err := strconv.Atoi(kv.value)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("%q: the memory must be a positive number of MB", kv.key+"="+kv.value)
+		}
+		group := sanitizeAnsibleGroup("mem_" + kv.key)
+		if seen[group] {
+			return nil, fmt.Errorf("tier %q is set more than once", kv.key)
+		}
+		seen[group] = true
+
+		buckets = append(buckets, memoryBucket{group: group, limit: limit})
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		return buckets[i].limit < buckets[j].limit
+	})
+
+	return buckets, nil
+}
+
+// memoryTier returns the group of the smallest bucket the Droplet's memory
+// fits in, or an empty string if it has more memory than the largest one
+func memoryTier(d godo.Droplet, buckets []memoryBucket) string {
+	for _, b := range buckets {
+		if d.Memory <= b.limit {
+			return b.group
+		}
+	}
+
+	return ""
+}
+
+// privateSubnetGroup returns the group name of the subnet the Droplet's private
+// IPv4 address belongs to, e.g. subnet_10_0_1_0_24 for 10.0.1.15 and mask 24
+func privateSubnetGroup(d godo.Droplet, mask int) (string, error) {
+	ip, err := d.PrivateIPv4()
+	if err != nil {
+		return "", err
+	}
+	if ip == "" {
+		return "", fmt.Errorf("the Droplet has no private IP")
+	}
+
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil {
+		return "", fmt.Errorf("couldn't parse private IP %q", ip)
+	}
+
+	network := parsed.Mask(net.CIDRMask(mask, 32)).String()
+	return fmt.Sprintf("subnet_%s_%d", strings.ReplaceAll(network, ".", "_"), mask), nil
+}
+
+func filterGPU(droplets []godo.Droplet, prefixes []string) []godo.Droplet {
+	newDroplets := droplets[:0]
+	for _, d := range droplets {
+		if !isGPUDroplet(d, prefixes) {
+			log.WithField("droplet", d.Name).Info("not a GPU Droplet, ignoring")
+			continue
+		}
+
+		newDroplets = append(newDroplets, d)
+	}
+
+	return newDroplets
+}
+
+// isGPUDroplet reports whether the Droplet's size slug starts with one of the
+// given GPU size prefixes
+func isGPUDroplet(d godo.Droplet, prefixes []string) bool {
+	size := d.SizeSlug
+	if size == "" && d.Size != nil {
+		size = d.Size.Slug
+	}
+
+	for _, p := range prefixes {
+		if p != "" && strings.HasPrefix(size, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// excludeClause is a set of conditions that must all match for a Droplet to
+// be excluded
+type excludeClause []keyValue
+
+// excludeFields are the Droplet attributes --exclude-where can match on
+var excludeFields = map[string]func(d godo.Droplet, value string) bool{
+	"name": func(d godo.Droplet, value string) bool {
+		return d.Name == value
+	},
+	"region": func(d godo.Droplet, value string) bool {
+		return d.Region != nil && d.Region.Slug == value
+	},
+	"tag": func(d godo.Droplet, value string) bool {
+		for _, t := range d.Tags {
+			if t == value {
+				return true
+			}
+		}
+		return false
+	},
+	"status": func(d godo.Droplet, value string) bool {
+		return d.Status == value
+	},
+	"size": func(d godo.Droplet, value string) bool {
+		return d.SizeSlug == value
+	},
+	"image": func(d godo.Droplet, value string) bool {
+		return d.Image != nil && d.Image.Slug == value
+	},
+	"vpc": func(d godo.Droplet, value string) bool {
+		return d.VPCUUID == value
+	},
+}
+
+// parseExcludeClause parses a clause such as region=nyc1,tag=staging
+func parseExcludeClause(s string) (excludeClause, error) {
+	conditions, err := parseKeyValues(SplitList(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("%q has no conditions", s)
+	}
+
+	for _, c := range conditions {
+		if _, ok := excludeFields[c.key]; !ok {
+			return nil, fmt.Errorf("%q: unknown field %q", s, c.key)
+		}
+	}
+
+	return excludeClause(conditions), nil
+}
+
+// matches reports whether the Droplet matches every condition of the clause
+func (c excludeClause) matches(d godo.Droplet) bool {
+	for _, cond := range c {
+		if !excludeFields[cond.key](d, cond.value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func removeExcludedWhere(droplets []godo.Droplet, clauses []excludeClause) []godo.Droplet {
+	newDroplets := droplets[:0]
+	for _, d := range droplets {
+		excluded := false
+		for _, c := range clauses {
+			if c.matches(d) {
+				excluded = true
+				break
+			}
+		}
+
+		if excluded {
+			log.WithField("droplet", d.Name).Info("excluded by --exclude-where, ignoring")
+			continue
+		}
+
+		newDroplets = append(newDroplets, d)
+	}
+
+	return newDroplets
+}
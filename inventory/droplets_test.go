@@ -0,0 +1,208 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestSanitizeAnsibleGroup(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", "_empty"},
+		{"valid", "web_servers", "web_servers"},
+		{"leading digit", "1password", "_1password"},
+		{"only digits", "2020", "_2020"},
+		{"hyphen", "web-01", "web_01"},
+		{"space", "my project", "my_project"},
+		{"colon", "env:prod", "env_prod"},
+		{"dots", "k8s.io", "k8s_io"},
+		{"slashes", "team/a/b", "team_a_b"},
+		{"parentheses", "db (primary)", "db__primary_"},
+		{"leading punctuation", ".hidden", "_hidden"},
+		{"unicode", "café", "caf_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeAnsibleGroup(tt.in); got != tt.want {
+				t.Errorf("sanitizeAnsibleGroup(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExcludeClause(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"single condition", "region=nyc1", 1, false},
+		{"compound", "region=nyc1,tag=staging", 2, false},
+		{"spaces", " region=nyc1 , tag=staging ", 2, false},
+		{"value with =", "tag=a=b", 1, false},
+		{"empty value", "vpc=", 1, false},
+		{"unknown field", "region=nyc1,owner=me", 0, true},
+		{"missing value", "region", 0, true},
+		{"missing field", "=nyc1", 0, true},
+		{"empty", "", 0, true},
+		{"only commas", ",,", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExcludeClause(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExcludeClause(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if len(got) != tt.want {
+				t.Errorf("parseExcludeClause(%q) has %d conditions, want %d", tt.in, len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveExcludedWhere(t *testing.T) {
+	droplets := func() []godo.Droplet {
+		staging := testDroplet(2, "web-02", "nyc1", "203.0.113.2", "staging")
+		staging.Status = "off"
+		return []godo.Droplet{
+			testDroplet(1, "web-01", "nyc1", "203.0.113.1", "prod"),
+			staging,
+			testDroplet(3, "web-03", "sfo3", "203.0.113.3", "staging"),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		clauses []string
+		want    []string
+	}{
+		{"all conditions must match", []string{"region=nyc1,tag=staging"}, []string{"web-01", "web-03"}},
+		{"no Droplet matches every condition", []string{"region=sfo3,tag=prod"}, []string{"web-01", "web-02", "web-03"}},
+		{"any clause excludes", []string{"region=nyc1,tag=prod", "region=sfo3"}, []string{"web-02"}},
+		{"three conditions", []string{"region=nyc1,tag=staging,status=off"}, []string{"web-01", "web-03"}},
+		{"three conditions, one mismatch", []string{"region=nyc1,tag=staging,status=active"}, []string{"web-01", "web-02", "web-03"}},
+		{"same field twice", []string{"tag=prod,tag=staging"}, []string{"web-01", "web-02", "web-03"}},
+		{"by name", []string{"name=web-03,tag=staging"}, []string{"web-01", "web-02"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var clauses []excludeClause
+			for _, s := range tt.clauses {
+				c, err := parseExcludeClause(s)
+				if err != nil {
+					t.Fatalf("parseExcludeClause(%q) error = %v", s, err)
+				}
+				clauses = append(clauses, c)
+			}
+
+			var got []string
+			for _, d := range removeExcludedWhere(droplets(), clauses) {
+				got = append(got, d.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("removeExcludedWhere(%q) = %q, want %q", tt.clauses, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveIgnoredCase(t *testing.T) {
+	droplets := func() []godo.Droplet {
+		return []godo.Droplet{
+			testDroplet(1, "web-01", "nyc3", "203.0.113.1"),
+			testDroplet(2, "Web-02", "nyc3", "203.0.113.2"),
+			testDroplet(3, "DB-01", "nyc3", "203.0.113.3"),
+		}
+	}
+
+	tests := []struct {
+		name       string
+		ignored    []string
+		ignoreCase bool
+		want       []string
+	}{
+		{"exact match", []string{"Web-02"}, false, []string{"web-01", "DB-01"}},
+		{"case differs", []string{"WEB-01", "db-01"}, false, []string{"web-01", "Web-02", "DB-01"}},
+		{"case differs, ignore case", []string{"WEB-01", "db-01"}, true, []string{"Web-02"}},
+		{"mixed case, ignore case", []string{"wEb-02"}, true, []string{"web-01", "DB-01"}},
+		{"exact match, ignore case", []string{"DB-01"}, true, []string{"web-01", "Web-02"}},
+		{"no match, ignore case", []string{"web-03"}, true, []string{"web-01", "Web-02", "DB-01"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, d := range removeIgnored(droplets(), tt.ignored, tt.ignoreCase, nil, nil) {
+				got = append(got, d.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("removeIgnored(%q, %t) = %q, want %q", tt.ignored, tt.ignoreCase, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagHierarchy(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		want map[string][]string
+	}{
+		{
+			name: "flat tags",
+			tags: []string{"web", "db"},
+			want: map[string][]string{},
+		},
+		{
+			name: "nested levels",
+			tags: []string{"team:payments:api", "team:payments:worker", "team:search"},
+			want: map[string][]string{
+				"team":          {"team_payments", "team_search"},
+				"team_payments": {"team_payments_api", "team_payments_worker"},
+			},
+		},
+		{
+			name: "empty level isn't merged into another hierarchy",
+			tags: []string{"team::api", "team:api"},
+			want: map[string][]string{
+				"team": {"team_api"},
+			},
+		},
+		{
+			name: "leading and trailing colons",
+			tags: []string{":api", "team:"},
+			want: map[string][]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dropletsByTag := make(map[string][]string, len(tt.tags))
+			for _, tag := range tt.tags {
+				dropletsByTag[tag] = []string{"web-01"}
+			}
+
+			if got := tagHierarchy(dropletsByTag, ""); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tagHierarchy(%q) = %v, want %v", tt.tags, got, tt.want)
+			}
+		})
+	}
+}
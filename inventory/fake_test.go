@@ -0,0 +1,89 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"context"
+	"errors"
+
+	"github.com/digitalocean/godo"
+)
+
+// fakeDroplets is a DropletLister returning canned Droplets in a single page
+type fakeDroplets struct {
+	droplets []godo.Droplet
+}
+
+func (f *fakeDroplets) List(context.Context, *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+	return f.droplets, &godo.Response{}, nil
+}
+
+func (f *fakeDroplets) ListByTag(_ context.Context, tag string, _ *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+	var droplets []godo.Droplet
+	for _, d := range f.droplets {
+		for _, t := range d.Tags {
+			if t == tag {
+				droplets = append(droplets, d)
+				break
+			}
+		}
+	}
+	return droplets, &godo.Response{}, nil
+}
+
+func (f *fakeDroplets) Backups(context.Context, int, *godo.ListOptions) ([]godo.Image, *godo.Response, error) {
+	return nil, &godo.Response{}, nil
+}
+
+// fakeProjects is a ProjectLister returning canned projects and their
+// resources, keyed by project ID, in a single page
+type fakeProjects struct {
+	projects  []godo.Project
+	resources map[string][]godo.ProjectResource
+}
+
+func (f *fakeProjects) List(context.Context, *godo.ListOptions) ([]godo.Project, *godo.Response, error) {
+	return f.projects, &godo.Response{}, nil
+}
+
+func (f *fakeProjects) ListResources(_ context.Context, id string, _ *godo.ListOptions) ([]godo.ProjectResource, *godo.Response, error) {
+	return f.resources[id], &godo.Response{}, nil
+}
+
+// fakeVPCs is a VPCGetter returning canned VPCs keyed by UUID
+type fakeVPCs struct {
+	vpcs map[string]*godo.VPC
+}
+
+func (f *fakeVPCs) Get(_ context.Context, id string) (*godo.VPC, *godo.Response, error) {
+	vpc, ok := f.vpcs[id]
+	if !ok {
+		return nil, &godo.Response{}, errors.New("not found")
+	}
+	return vpc, &godo.Response{}, nil
+}
+
+// testDroplet returns an active Droplet with a public IPv4 address
+func testDroplet(id int, name, region, ip string, tags ...string) godo.Droplet {
+	return godo.Droplet{
+		ID:     id,
+		Name:   name,
+		Status: "active",
+		Region: &godo.Region{Slug: region},
+		Tags:   tags,
+		Networks: &godo.Networks{
+			V4: []godo.NetworkV4{{IPAddress: ip, Type: "public"}},
+		},
+	}
+}
@@ -0,0 +1,728 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Inventory holds the hosts and groups that are rendered into the Ansible
+// inventory. Hosts and groups keep the order they were added in.
+type Inventory struct {
+	hosts  []*host
+	groups []*group
+
+	groupsByName map[string]*group
+}
+
+type host struct {
+	name string
+	vars []variable
+
+	// region and tags label the host's targets in PrometheusTargets
+	region string
+	tags   []string
+}
+
+type group struct {
+	name     string
+	hosts    []string
+	children []string
+	vars     []variable
+
+	// kind is the dimension of region, tag, and project groups, which Split
+	// splits the inventory by
+	kind string
+
+	members map[string]bool
+}
+
+// variable is a host or group var. value is a string, int, bool, or []string.
+type variable struct {
+	key   string
+	value interface{}
+}
+
+// Hosts returns the number of hosts in the inventory
+func (inv *Inventory) Hosts() int {
+	return len(inv.hosts)
+}
+
+// Groups returns the number of groups in the inventory
+func (inv *Inventory) Groups() int {
+	return len(inv.groups)
+}
+
+// GroupSize is the number of hosts of a group
+type GroupSize struct {
+	Name  string
+	Hosts int
+}
+
+// GroupSizes returns the number of hosts of every group, in the order the
+// groups were added. Hosts of child groups aren't counted.
+func (inv *Inventory) GroupSizes() []GroupSize {
+	sizes := make([]GroupSize, 0, len(inv.groups))
+	for _, g := range inv.groups {
+		sizes = append(sizes, GroupSize{Name: g.name, Hosts: len(g.hosts)})
+	}
+
+	return sizes
+}
+
+// addHost adds a host with its vars
+func (inv *Inventory) addHost(name string, vars []variable) *host {
+	h := &host{name: name, vars: vars}
+	inv.hosts = append(inv.hosts, h)
+	return h
+}
+
+// group returns the group with the given name, adding it if it doesn't exist
+func (inv *Inventory) group(name string) *group {
+	if g, ok := inv.groupsByName[name]; ok {
+		return g
+	}
+
+	if inv.groupsByName == nil {
+		inv.groupsByName = map[string]*group{}
+	}
+
+	g := &group{name: name, members: map[string]bool{}}
+	inv.groupsByName[name] = g
+	inv.groups = append(inv.groups, g)
+	return g
+}
+
+// addHosts adds hosts to the group, skipping ones that are already members
+func (g *group) addHosts(hosts ...string) {
+	for _, h := range hosts {
+		if g.members[h] {
+			continue
+		}
+
+		g.members[h] = true
+		g.hosts = append(g.hosts, h)
+	}
+}
+
+// addChildren adds child groups to the group
+func (g *group) addChildren(children ...string) {
+	g.children = append(g.children, children...)
+}
+
+// setVar adds a group var
+func (g *group) setVar(key string, value interface{}) {
+	g.vars = append(g.vars, variable{key: key, value: value})
+}
+
+// SplitInventory is the part of an inventory for a single group
+type SplitInventory struct {
+	Group     string
+	Inventory *Inventory
+}
+
+// Split splits the inventory by region, tag, or project. Every region, tag, or
+// project group with hosts gets an inventory with its hosts and their vars, the
+// group, and the all group's vars. The groups keep their order.
+func (inv *Inventory) Split(kind string) []SplitInventory {
+	var splits []SplitInventory
+	for _, g := range inv.groups {
+		if g.kind != kind || len(g.hosts) == 0 {
+			continue
+		}
+
+		split := &Inventory{}
+		for _, h := range inv.hosts {
+			if g.members[h.name] {
+				added := split.addHost(h.name, h.vars)
+				added.region, added.tags = h.region, h.tags
+			}
+		}
+		if all, ok := inv.groupsByName["all"]; ok && len(all.vars) > 0 {
+			split.group("all").vars = all.vars
+		}
+		sg := split.group(g.name)
+		sg.addHosts(g.hosts...)
+		sg.vars = g.vars
+		sg.kind = g.kind
+
+		splits = append(splits, SplitInventory{Group: g.name, Inventory: split})
+	}
+
+	return splits
+}
+
+// Render renders the inventory in the given format, ini, yaml, toml, json or
+// ssh-config
+func (inv *Inventory) Render(format string) (*bytes.Buffer, error) {
+	var b bytes.Buffer
+	err := inv.Write(&b, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+// Write writes the inventory to w in the given format, ini, yaml, toml, json
+// or ssh-config. The INI and ssh-config formats are written host by host and
+// group by group instead of being rendered in memory first.
+func (inv *Inventory) Write(w io.Writer, format string) error {
+	bw := bufio.NewWriter(w)
+
+	var err error
+	switch format {
+	case "ini":
+		inv.ini(bw)
+	case "yaml":
+		err = inv.yaml(bw)
+	case "toml":
+		err = inv.toml(bw)
+	case "json":
+		err = inv.json(bw)
+	case "ssh-config":
+		inv.sshConfig(bw)
+	default:
+		return fmt.Errorf("unknown inventory format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	// bufio.Writer keeps the first write error, so it's returned by Flush
+	return bw.Flush()
+}
+
+// ini writes the inventory in Ansible's INI format. Sections are separated by
+// exactly one blank line and no line has trailing spaces, so that committed
+// inventories diff cleanly.
+func (inv *Inventory) ini(b *bufio.Writer) {
+	sections := 0
+	section := func(header string) {
+		if sections > 0 {
+			b.WriteRune('\n')
+		}
+		sections++
+
+		if header != "" {
+			b.WriteString(header)
+			b.WriteRune('\n')
+		}
+	}
+
+	if len(inv.hosts) > 0 {
+		section("")
+	}
+	for _, h := range inv.hosts {
+		b.WriteString(h.name)
+		for _, v := range h.vars {
+			b.WriteString(fmt.Sprintf(" %s=%s", v.key, iniValue(v.value)))
+		}
+		b.WriteRune('\n')
+	}
+
+	for _, g := range inv.groups {
+		// groups that only carry children or vars don't need a hosts section
+		if len(g.hosts) > 0 || (len(g.children) == 0 && len(g.vars) == 0) {
+			section(fmt.Sprintf("[%s]", g.name))
+			for _, h := range g.hosts {
+				b.WriteString(h)
+				b.WriteRune('\n')
+			}
+		}
+
+		if len(g.children) > 0 {
+			section(fmt.Sprintf("[%s:children]", g.name))
+			for _, c := range g.children {
+				b.WriteString(c)
+				b.WriteRune('\n')
+			}
+		}
+
+		if len(g.vars) > 0 {
+			section(fmt.Sprintf("[%s:vars]", g.name))
+			for _, v := range g.vars {
+				b.WriteString(fmt.Sprintf("%s=%v", v.key, v.value))
+				b.WriteRune('\n')
+			}
+		}
+	}
+}
+
+// yaml writes the inventory in the format of Ansible's YAML inventory plugin.
+// Host vars are set in the all group, the other groups are its children and
+// only list their hosts. Hosts and groups keep their order.
+func (inv *Inventory) yaml(w io.Writer) error {
+	hosts := yaml.MapSlice{}
+	seen := map[string]int{}
+	for _, h := range inv.hosts {
+		if i, ok := seen[h.name]; ok {
+			hosts[i].Value = append(hosts[i].Value.(yaml.MapSlice), yamlVars(h.vars)...)
+			continue
+		}
+
+		seen[h.name] = len(hosts)
+		hosts = append(hosts, yaml.MapItem{Key: h.name, Value: yamlVars(h.vars)})
+	}
+
+	all := yaml.MapSlice{{Key: "hosts", Value: hosts}}
+	children := yaml.MapSlice{}
+	for _, g := range inv.groups {
+		if g.name == "all" {
+			if len(g.vars) > 0 {
+				all = append(all, yaml.MapItem{Key: "vars", Value: yamlVars(g.vars)})
+			}
+			continue
+		}
+
+		group := yaml.MapSlice{}
+		if len(g.hosts) > 0 {
+			members := make(yaml.MapSlice, 0, len(g.hosts))
+			for _, h := range g.hosts {
+				members = append(members, yaml.MapItem{Key: h, Value: nil})
+			}
+			group = append(group, yaml.MapItem{Key: "hosts", Value: members})
+		}
+		if len(g.children) > 0 {
+			members := make(yaml.MapSlice, 0, len(g.children))
+			for _, c := range g.children {
+				members = append(members, yaml.MapItem{Key: c, Value: nil})
+			}
+			group = append(group, yaml.MapItem{Key: "children", Value: members})
+		}
+		if len(g.vars) > 0 {
+			group = append(group, yaml.MapItem{Key: "vars", Value: yamlVars(g.vars)})
+		}
+
+		children = append(children, yaml.MapItem{Key: g.name, Value: group})
+	}
+	if len(children) > 0 {
+		all = append(all, yaml.MapItem{Key: "children", Value: children})
+	}
+
+	out, err := yaml.Marshal(yaml.MapSlice{{Key: "all", Value: all}})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(out)
+	return err
+}
+
+// yamlVars returns the vars as a YAML mapping, keeping their order
+func yamlVars(vars []variable) yaml.MapSlice {
+	m := make(yaml.MapSlice, 0, len(vars))
+	for _, v := range vars {
+		m = append(m, yaml.MapItem{Key: v.key, Value: v.value})
+	}
+	return m
+}
+
+// GroupVarsFile is the content of a group_vars/<group>.yml file
+type GroupVarsFile struct {
+	Group   string
+	Content []byte
+}
+
+// GroupVarsFiles renders the vars of every group that has vars as the YAML of
+// a group_vars file, in the order the groups were added
+func (inv *Inventory) GroupVarsFiles() ([]GroupVarsFile, error) {
+	var files []GroupVarsFile
+	for _, g := range inv.groups {
+		if len(g.vars) == 0 {
+			continue
+		}
+
+		out, err := yaml.Marshal(yamlVars(g.vars))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, GroupVarsFile{Group: g.name, Content: out})
+	}
+
+	return files, nil
+}
+
+// toml writes the inventory in the format of Ansible's TOML inventory plugin.
+// Host vars are set in the all group, the other groups only list their hosts.
+func (inv *Inventory) toml(w io.Writer) error {
+	hosts := make(map[string]interface{}, len(inv.hosts))
+	for _, h := range inv.hosts {
+		vars, ok := hosts[h.name].(map[string]interface{})
+		if !ok {
+			vars = make(map[string]interface{}, len(h.vars))
+			hosts[h.name] = vars
+		}
+		for _, v := range h.vars {
+			vars[v.key] = v.value
+		}
+	}
+
+	doc := map[string]interface{}{
+		"all": map[string]interface{}{"hosts": hosts},
+	}
+
+	for _, g := range inv.groups {
+		t, ok := doc[g.name].(map[string]interface{})
+		if !ok {
+			t = map[string]interface{}{}
+			doc[g.name] = t
+		}
+
+		if len(g.hosts) > 0 && g.name != "all" {
+			members := make(map[string]interface{}, len(g.hosts))
+			for _, h := range g.hosts {
+				members[h] = map[string]interface{}{}
+			}
+			t["hosts"] = members
+		}
+
+		if len(g.children) > 0 {
+			t["children"] = g.children
+		}
+
+		if len(g.vars) > 0 {
+			vars := make(map[string]interface{}, len(g.vars))
+			for _, v := range g.vars {
+				vars[v.key] = v.value
+			}
+			t["vars"] = vars
+		}
+	}
+
+	return toml.NewEncoder(w).Encode(doc)
+}
+
+// json writes the inventory as the JSON expected from dynamic inventory
+// scripts called with --list. Every host is listed in the all group and its
+// vars are set in _meta.hostvars, groups without hosts, children or vars are
+// left out.
+func (inv *Inventory) json(w io.Writer) error {
+	type jsonGroup struct {
+		Hosts    []string               `json:"hosts,omitempty"`
+		Children []string               `json:"children,omitempty"`
+		Vars     map[string]interface{} `json:"vars,omitempty"`
+	}
+
+	all := &jsonGroup{Hosts: []string{}}
+	hostvars := make(map[string]map[string]interface{}, len(inv.hosts))
+	for _, h := range inv.hosts {
+		vars, ok := hostvars[h.name]
+		if !ok {
+			vars = make(map[string]interface{}, len(h.vars))
+			hostvars[h.name] = vars
+			all.Hosts = append(all.Hosts, h.name)
+		}
+		for _, v := range h.vars {
+			vars[v.key] = v.value
+		}
+	}
+
+	doc := map[string]interface{}{
+		"all":   all,
+		"_meta": map[string]interface{}{"hostvars": hostvars},
+	}
+
+	for _, g := range inv.groups {
+		if len(g.hosts) == 0 && len(g.children) == 0 && len(g.vars) == 0 {
+			continue
+		}
+
+		jg := all
+		if g.name != "all" {
+			jg = &jsonGroup{Hosts: g.hosts, Children: g.children}
+			doc[g.name] = jg
+		}
+
+		if len(g.vars) > 0 {
+			jg.Vars = make(map[string]interface{}, len(g.vars))
+			for _, v := range g.vars {
+				jg.Vars[v.key] = v.value
+			}
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// sshConfig writes the hosts as an OpenSSH client config, with a Host block
+// per host using its ansible_host, ansible_user, and ansible_port, the latter
+// two falling back to the all group's vars. Groups aren't rendered.
+func (inv *Inventory) sshConfig(w io.Writer) {
+	defaults := map[string]interface{}{}
+	if all, ok := inv.groupsByName["all"]; ok {
+		for _, v := range all.vars {
+			defaults[v.key] = v.value
+		}
+	}
+
+	var names []string
+	vars := map[string]map[string]interface{}{}
+	for _, h := range inv.hosts {
+		if _, ok := vars[h.name]; !ok {
+			names = append(names, h.name)
+			vars[h.name] = map[string]interface{}{}
+		}
+		for _, v := range h.vars {
+			vars[h.name][v.key] = v.value
+		}
+	}
+
+	for i, name := range names {
+		if i > 0 {
+			fmt.Fprint(w, "\n")
+		}
+		fmt.Fprintf(w, "Host %s\n", name)
+
+		for _, o := range []struct{ option, key string }{
+			{"HostName", "ansible_host"},
+			{"User", "ansible_user"},
+			{"Port", "ansible_port"},
+		} {
+			value, ok := vars[name][o.key]
+			if !ok {
+				value, ok = defaults[o.key]
+			}
+			if ok {
+				fmt.Fprintf(w, "  %s %v\n", o.option, value)
+			}
+		}
+	}
+}
+
+// PrometheusTargets renders the hosts as Prometheus file_sd targets, with
+// their ansible_host and port as the target address. Hosts in the same region
+// with the same tags share an entry labeled with the region and the
+// comma-separated tags. Hosts without an ansible_host are left out.
+func (inv *Inventory) PrometheusTargets(port int) (*bytes.Buffer, error) {
+	type entry struct {
+		Targets []string          `json:"targets"`
+		Labels  map[string]string `json:"labels"`
+	}
+
+	entries := []*entry{}
+	byLabels := map[string]*entry{}
+	for _, h := range inv.hosts {
+		address := ""
+		for _, v := range h.vars {
+			if v.key == "ansible_host" {
+				address = fmt.Sprint(v.value)
+			}
+		}
+		if address == "" {
+			continue
+		}
+
+		tags := strings.Join(h.tags, ",")
+		key := h.region + "\x00" + tags
+		e, ok := byLabels[key]
+		if !ok {
+			e = &entry{Labels: map[string]string{"region": h.region, "tags": tags}}
+			byLabels[key] = e
+			entries = append(entries, e)
+		}
+		e.Targets = append(e.Targets, net.JoinHostPort(address, strconv.Itoa(port)))
+	}
+
+	out, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, '\n')
+
+	return bytes.NewBuffer(out), nil
+}
+
+// HostJSON renders the vars of the named host as the JSON expected from
+// dynamic inventory scripts called with --host, or {} if there's no such host
+func (inv *Inventory) HostJSON(name string) (*bytes.Buffer, error) {
+	vars := map[string]interface{}{}
+	for _, h := range inv.hosts {
+		if h.name != name {
+			continue
+		}
+		for _, v := range h.vars {
+			vars[v.key] = v.value
+		}
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+// iniValue formats an inline host var. Strings that Ansible wouldn't parse as
+// a single string, such as ones containing spaces or commas, are quoted. Lists
+// are written as JSON, which Ansible parses back into a list.
+func iniValue(v interface{}) string {
+	if l, ok := v.([]string); ok {
+		b, err := json.Marshal(l)
+		if err != nil {
+			// a list of strings always marshals
+			panic(err)
+		}
+		v = string(b)
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Sprintf("%v", v)
+	}
+
+	switch {
+	case s != "" && !strings.ContainsAny(s, " \t,'\"=#;"):
+		return s
+	case !strings.Contains(s, `"`):
+		return `"` + s + `"`
+	case !strings.Contains(s, "'"):
+		return "'" + s + "'"
+	default:
+		return strconv.Quote(s)
+	}
+}
+
+// Fingerprint returns a SHA256 hash of the inventory's hosts, groups, and
+// vars. Everything is sorted before hashing so the fingerprint only changes
+// when the inventory's content does, not its order.
+func (inv *Inventory) Fingerprint() string {
+	var lines []string
+
+	for _, h := range inv.hosts {
+		lines = append(lines, "host "+h.name)
+		for _, v := range h.vars {
+			lines = append(lines, fmt.Sprintf("host %s var %s=%v", h.name, v.key, v.value))
+		}
+	}
+
+	for _, g := range inv.groups {
+		lines = append(lines, "group "+g.name)
+		for _, h := range g.hosts {
+			lines = append(lines, fmt.Sprintf("group %s host %s", g.name, h))
+		}
+		for _, c := range g.children {
+			lines = append(lines, fmt.Sprintf("group %s child %s", g.name, c))
+		}
+		for _, v := range g.vars {
+			lines = append(lines, fmt.Sprintf("group %s var %s=%v", g.name, v.key, v.value))
+		}
+	}
+
+	sort.Strings(lines)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// encodedInventory is the gob encoding of an Inventory
+type encodedInventory struct {
+	Hosts  []encodedHost
+	Groups []encodedGroup
+}
+
+type encodedHost struct {
+	Name   string
+	Vars   []encodedVar
+	Region string
+	Tags   []string
+}
+
+type encodedGroup struct {
+	Name     string
+	Hosts    []string
+	Children []string
+	Vars     []encodedVar
+	Kind     string
+}
+
+type encodedVar struct {
+	Key   string
+	Value interface{}
+}
+
+// GobEncode encodes the inventory, e.g. to cache it
+func (inv *Inventory) GobEncode() ([]byte, error) {
+	var e encodedInventory
+	for _, h := range inv.hosts {
+		e.Hosts = append(e.Hosts, encodedHost{Name: h.name, Vars: encodeVars(h.vars), Region: h.region, Tags: h.tags})
+	}
+	for _, g := range inv.groups {
+		e.Groups = append(e.Groups, encodedGroup{Name: g.name, Hosts: g.hosts, Children: g.children, Vars: encodeVars(g.vars), Kind: g.kind})
+	}
+
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(e)
+	return b.Bytes(), err
+}
+
+// GobDecode decodes an inventory encoded by GobEncode
+func (inv *Inventory) GobDecode(data []byte) error {
+	var e encodedInventory
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e)
+	if err != nil {
+		return err
+	}
+
+	*inv = Inventory{}
+	for _, h := range e.Hosts {
+		added := inv.addHost(h.Name, decodeVars(h.Vars))
+		added.region, added.tags = h.Region, h.Tags
+	}
+	for _, eg := range e.Groups {
+		g := inv.group(eg.Name)
+		g.addHosts(eg.Hosts...)
+		g.addChildren(eg.Children...)
+		g.vars = decodeVars(eg.Vars)
+		g.kind = eg.Kind
+	}
+
+	return nil
+}
+
+func encodeVars(vars []variable) []encodedVar {
+	encoded := make([]encodedVar, 0, len(vars))
+	for _, v := range vars {
+		encoded = append(encoded, encodedVar{Key: v.key, Value: v.value})
+	}
+	return encoded
+}
+
+func decodeVars(encoded []encodedVar) []variable {
+	vars := make([]variable, 0, len(encoded))
+	for _, v := range encoded {
+		vars = append(vars, variable{key: v.Key, value: v.Value})
+	}
+	return vars
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestINIGolden builds the inventory of a fixed set of Droplets and compares
+// its INI rendering byte for byte to testdata/inventory.ini.golden. Run the
+// test with -update to rewrite the golden file.
+func TestINIGolden(t *testing.T) {
+	client := Client{
+		Droplets: &fakeDroplets{droplets: []godo.Droplet{
+			testDroplet(1, "web-01", "nyc3", "203.0.113.1", "web", "prod"),
+			testDroplet(2, "web-02", "nyc3", "203.0.113.2", "web", "canary"),
+			testDroplet(3, "web-01", "nyc3", "203.0.113.3", "web"),
+			testDroplet(4, "db-01", "sfo3", "203.0.113.4", "db"),
+			testDroplet(5, "tmp-01", "nyc3", "203.0.113.5", "scratch"),
+		}},
+	}
+	cfg := Config{
+		Ignore:               []string{"tmp-01"},
+		GroupByRegion:        true,
+		Regions:              []string{"ams3", "nyc3", "sfo3"},
+		RegionParent:         "regions",
+		GroupByTag:           true,
+		SSHUser:              "root",
+		SSHPort:              2222,
+		InsecureHostKeysTags: []string{"canary"},
+		TagsAsVar:            true,
+		SortHostsBy:          "name",
+	}
+
+	inv, _, err := Build(context.Background(), client, cfg)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	rendered, err := inv.Render("ini")
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+
+	golden := filepath.Join("testdata", "inventory.ini.golden")
+	if *update {
+		err = ioutil.WriteFile(golden, rendered.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rendered.String(); got != string(want) {
+		t.Errorf("Render() =\n%s\nwant\n%s", got, want)
+	}
+}
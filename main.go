@@ -16,16 +16,25 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/cli"
+	"github.com/apex/log/handlers/json"
 	"github.com/digitalocean/godo"
+	"github.com/do-community/do-ansible-inventory/inventory"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"gopkg.in/yaml.v2"
 )
@@ -35,24 +44,288 @@ var (
 	sshUser        = kingpin.Flag("ssh-user", "default ssh user").String()
 	sshPort        = kingpin.Flag("ssh-port", "default ssh port").Int()
 	tag            = kingpin.Flag("tag", "filter droplets by tag").String()
-	ignore         = kingpin.Flag("ignore", "ignore a Droplet by name, can be specified multiple times").Strings()
+	ignore         = kingpin.Flag("ignore", "ignore a Droplet by name, can be specified multiple times. env var: DO_INVENTORY_IGNORE, comma-separated and added to the flags").Strings()
 	groupByRegion  = kingpin.Flag("group-by-region", "group hosts by region, defaults to true").Default("true").Bool()
 	groupByTag     = kingpin.Flag("group-by-tag", "group hosts by their Droplet tags, defaults to true").Default("true").Bool()
 	groupByProject = kingpin.Flag("group-by-project", "group hosts by their Projects, defaults to true").Default("true").Bool()
 	privateIPs     = kingpin.Flag("private-ips", "use private Droplet IPs instead of public IPs").Bool()
 	out            = kingpin.Flag("out", "write the ansible inventory to this file - if unset, print to stdout").String()
 	timeout        = kingpin.Flag("timeout", "timeout for total runtime of the command, defaults to 2m").Default("2m").Duration()
+
+	connectionVarsAtGroupLevel = kingpin.Flag("connection-vars-at-group-level", "write ansible_user and ansible_port once in [all:vars] instead of on every host").Bool()
+
+	gpuOnly         = kingpin.Flag("gpu-only", "only include GPU Droplets").Bool()
+	groupByGPU      = kingpin.Flag("group-by-gpu", "group GPU Droplets in a gpu group").Bool()
+	gpuSizePrefixes = kingpin.Flag("gpu-size-prefix", "size slug prefix that identifies a GPU Droplet, can be specified multiple times, defaults to gpu-").Default("gpu-").Strings()
+
+	writePartialOnTimeout = kingpin.Flag("write-partial-on-timeout", "if the timeout is reached, write the inventory assembled so far marked as partial and exit non-zero").Bool()
+
+	excludeDefaultProjectGroup = kingpin.Flag("exclude-default-project-group", "don't create a group for the account's default Project").Bool()
+
+	sortHostsBy = kingpin.Flag("sort-hosts", "sort hosts within the inventory and each group by name or ip - if unset, keep the API's order").Enum("name", "ip")
+
+	tagRequireAll = kingpin.Flag("tag-require-all", "comma-separated list of tags, only include Droplets that have all of them").String()
+	tagRequireAny = kingpin.Flag("tag-require-any", "comma-separated list of tags, only include Droplets that have at least one of them").String()
+
+	regionVars = kingpin.Flag("region-vars", "write each region's availability and features as region group vars").Bool()
+
+	userAgentSuffix = kingpin.Flag("user-agent-suffix", "identifier appended to the User-Agent sent to the DigitalOcean API").String()
+
+	includeBackupIDs        = kingpin.Flag("include-backup-ids", "set the do_latest_backup_id host var - makes an extra API call per Droplet with backups").Bool()
+	backupLookupConcurrency = kingpin.Flag("backup-lookup-concurrency", "maximum number of concurrent backup lookups, defaults to 5").Default("5").Int()
+
+	configFile = kingpin.Flag("config", "YAML config file containing option profiles").String()
+	profile    = kingpin.Flag("profile", "apply the options of this profile from the config file - its top-level options, env vars, and flags take precedence").String()
+
+	changedSince = kingpin.Flag("changed-since", "only include Droplets created since this RFC3339 timestamp or duration ago, e.g. 24h").String()
+
+	groupByPrivateSubnet = kingpin.Flag("group-by-private-subnet", "group hosts by the subnet of their private IP, e.g. subnet_10_0_1_0_24").Bool()
+	privateSubnetMask    = kingpin.Flag("private-subnet-mask", "prefix length of the subnets used by --group-by-private-subnet, defaults to 24").Default("24").Int()
+
+	includeIDsFile = kingpin.Flag("include-ids-file", "only include the Droplets whose IDs are listed in this file, one per line").String()
+
+	sshExtraArgsFor = kingpin.Flag("ssh-extra-args-for", "set ansible_ssh_extra_args on Droplets with a tag, in the form tag=args, can be specified multiple times").Strings()
+
+	featuresAsVar = kingpin.Flag("features-as-var", "set the do_features host var to a comma-separated list of the Droplet's features").Bool()
+
+	hierarchicalTags = kingpin.Flag("hierarchical-tags", "nest groups of tags containing : under parent groups for each level, e.g. team > team_payments > team_payments_api").Bool()
+
+	fingerprintOut = kingpin.Flag("fingerprint-out", "write a SHA256 fingerprint of the inventory's hosts, groups, and vars to this file").String()
+
+	excludeWhere = kingpin.Flag("exclude-where", "ignore Droplets matching every condition of a comma-separated clause such as region=nyc1,tag=staging, can be specified multiple times").Strings()
+
+	includePanelURL = kingpin.Flag("include-panel-url", "set the do_panel_url host var to the Droplet's control panel URL").Bool()
+
+	metricsOut = kingpin.Flag("metrics-out", "write run metrics to this file in the Prometheus text format, e.g. for node_exporter's textfile collector").String()
+
+	hostOverride     = kingpin.Flag("host-override", "force ansible_host for a Droplet, in the form name=address, can be specified multiple times").Strings()
+	hostOverrideFile = kingpin.Flag("host-override-file", "file of name=address ansible_host overrides, one per line").String()
+
+	groupByNamePrefix   = kingpin.Flag("group-by-name-prefix", "group hosts by the part of their name before the first --name-prefix-delimiter, e.g. web for web-01").Bool()
+	namePrefixDelimiter = kingpin.Flag("name-prefix-delimiter", "delimiter used by --group-by-name-prefix, defaults to -").Default("-").String()
+
+	skipUnchanged = kingpin.Flag("skip-unchanged", "don't rewrite the --out file if its content wouldn't change, ignoring comments and whitespace").Bool()
+
+	tagsUnion = kingpin.Flag("tags-union", "comma-separated list of tags, list the Droplets of each tag concurrently and include the union").String()
+
+	fqdnDomain = kingpin.Flag("fqdn-domain", "set the do_fqdn host var to the Droplet's name in this domain, e.g. example.com").String()
+	useFQDN    = kingpin.Flag("use-fqdn", "use do_fqdn as ansible_host and keep the IP address in do_ip, requires --fqdn-domain").Bool()
+
+	hostAliasFrom = kingpin.Flag("host-alias-from", "what to use as the inventory host name: name, id, private-ip or tag:<key> for the value of a key:value tag").Default("name").String()
+
+	groupByLifecycle = kingpin.Flag("group-by-lifecycle", "group hosts into lifecycle_new, lifecycle_active and lifecycle_off by their status and age").Bool()
+	lifecycleNewAge  = kingpin.Flag("lifecycle-new-age", "active Droplets created less than this long ago are grouped into lifecycle_new").Default("1h").Duration()
+
+	format = kingpin.Flag("format", "format of the inventory, ini, yaml, toml, ssh-config or prometheus").Default("ini").Enum("ini", "yaml", "toml", "ssh-config", "prometheus")
+
+	force = kingpin.Flag("force", "overwrite --out even if it was written for a different DigitalOcean account").Bool()
+
+	list        = kingpin.Flag("list", "write the inventory as the JSON expected from Ansible dynamic inventory scripts, overrides --format").Bool()
+	hostVarsFor = kingpin.Flag("host", "write the vars of this host as the JSON expected from Ansible dynamic inventory scripts").String()
+
+	ipv6         = kingpin.Flag("ipv6", "use the Droplet's public IPv6 address as ansible_host, same as --ip-preference=ipv6").Bool()
+	ipPreference = kingpin.Flag("ip-preference", "comma-separated order of the address families to use for ansible_host, e.g. ipv4,ipv6 to fall back to IPv6, defaults to ipv4").String()
+
+	groupByImage = kingpin.Flag("group-by-image", "group hosts by their image's slug, or its distribution for images without one, e.g. ubuntu_22_04_x64").Bool()
+
+	regionList = kingpin.Flag("regions", "comma-separated list of regions to always write groups for, even if they have no Droplets, defaults to all known regions").String()
+
+	statuses = kingpin.Flag("status", "only include Droplets with this status, one of active, off, new or archive, can be specified multiple times").Enums("active", "off", "new", "archive")
+
+	matchAllTags = kingpin.Flag("match-all-tags", "only include Droplets that have this tag, can be specified multiple times to require all of them").Strings()
+
+	ignoreTag   = kingpin.Flag("ignore-tag", "ignore Droplets with a tag, can be specified multiple times").Strings()
+	ignoreRegex = kingpin.Flag("ignore-regex", "ignore Droplets whose name matches a regular expression, can be specified multiple times").Strings()
+
+	projectConcurrency = kingpin.Flag("project-concurrency", "maximum number of projects whose resources are listed concurrently, defaults to 5").Default("5").Int()
+
+	maxRetries = kingpin.Flag("max-retries", "maximum number of times a rate limited or failed API listing is retried, defaults to 3").Default("3").Int()
+
+	dedupe = kingpin.Flag("dedupe", "how to handle Droplets with the same host name: id appends the Droplet's ID, skip leaves out all but the first, error fails").Default("id").Enum("id", "skip", "error")
+
+	hostVars = kingpin.Flag("host-vars", "set the do_droplet_id and do_region host vars").Bool()
+
+	pythonInterpreter = kingpin.Flag("python-interpreter", "set ansible_python_interpreter on every host, or auto to use /usr/bin/python3 on Ubuntu 20.04+ and Debian 10+ images").String()
+
+	sshUserForTag = kingpin.Flag("ssh-user-for-tag", "set ansible_user on Droplets with a tag instead of --ssh-user, in the form tag=user, can be specified multiple times").Strings()
+
+	sshKeyFile       = kingpin.Flag("ssh-key-file", "set ansible_ssh_private_key_file on every host").String()
+	sshKeyFileForTag = kingpin.Flag("ssh-key-file-for-tag", "set ansible_ssh_private_key_file on Droplets with a tag instead of --ssh-key-file, in the form tag=path, can be specified multiple times").Strings()
+
+	bastion    = kingpin.Flag("bastion", "connect to hosts through this jump host, a Droplet name or an address").String()
+	bastionTag = kingpin.Flag("bastion-tag", "Droplets with this tag are bastions and are connected to directly").String()
+
+	groupByVPC = kingpin.Flag("group-by-vpc", "group hosts by VPC, named vpc_<name> after the VPC's name").Bool()
+
+	dryRun = kingpin.Flag("dry-run", "print a summary of the inventory instead of writing it, exiting non-zero if it has no hosts").Bool()
+
+	allowEmpty = kingpin.Flag("allow-empty", "write the inventory even if no Droplets matched instead of exiting with code 3").Bool()
+
+	ignoreFile = kingpin.Flag("ignore-file", "file of Droplet names to ignore, one per line").String()
+
+	doctlContext = kingpin.Flag("doctl-context", "use the access token of this doctl auth context instead of the current one. env var: DIGITALOCEAN_CONTEXT").Envar("DIGITALOCEAN_CONTEXT").String()
+
+	logLevel  = kingpin.Flag("log-level", "minimum level of the logs, debug, info, warn, or error").Default("info").Enum("debug", "info", "warn", "error")
+	logFormat = kingpin.Flag("log-format", "format of the logs, text or json").Default("text").Enum("text", "json")
+
+	cacheFile = kingpin.Flag("cache-file", "cache the inventory in this file and reuse it on the next runs within --cache-ttl").String()
+	cacheTTL  = kingpin.Flag("cache-ttl", "how long the --cache-file is reused for").Default("5m").Duration()
+
+	includeLoadBalancers = kingpin.Flag("include-load-balancers", "add the load balancers as hosts of a load_balancers group").Bool()
+
+	includeDatabases = kingpin.Flag("include-databases", "add the managed database clusters as hosts of a databases group").Bool()
+
+	preferReservedIP = kingpin.Flag("prefer-reserved-ip", "use the reserved IP assigned to a Droplet as ansible_host").Bool()
+
+	groupByFeature = kingpin.Flag("group-by-feature", "group hosts by enabled feature as feature_<name>, and the hosts lacking it as no_<name>").Bool()
+
+	includeRegions = kingpin.Flag("region", "only include Droplets in a region, can be specified multiple times").Strings()
+	excludeRegions = kingpin.Flag("exclude-region", "ignore Droplets in a region, can be specified multiple times").Strings()
+
+	groupVarsDir = kingpin.Flag("group-vars-dir", "also write the group vars to <group>.yml files in this directory").String()
+
+	regionParent = kingpin.Flag("region-parent", "make the region groups children of this group").String()
+	tagParent    = kingpin.Flag("tag-parent", "make the tag groups children of this group").String()
+
+	regionPrefix  = kingpin.Flag("region-prefix", "prefix of the region group names, e.g. region_").String()
+	tagPrefix     = kingpin.Flag("tag-prefix", "prefix of the tag group names, e.g. tag_").String()
+	projectPrefix = kingpin.Flag("project-prefix", "prefix of the project group names, e.g. project_").String()
+
+	apiURL = kingpin.Flag("api-url", "base URL of the DigitalOcean API, e.g. of a mock server or a proxy. env var: DIGITALOCEAN_API_URL").Envar("DIGITALOCEAN_API_URL").String()
+
+	retryBaseDelay = kingpin.Flag("retry-base-delay", "wait before the first retry of an API listing that failed with a server or network error, doubling for every retry").Default("1s").Duration()
+
+	resolveConcurrency = kingpin.Flag("resolve-concurrency", "maximum number of Droplets whose host name and address are looked up at once").Default("8").Int()
+
+	metricsPort = kingpin.Flag("metrics-port", "port of the targets written with --format prometheus").Default("9100").Int()
+
+	perPage = kingpin.Flag("per-page", "number of items requested per page of the API listings, up to 200, defaults to the API's page size").Int()
+
+	tagsAsVar = kingpin.Flag("tags-as-var", "set the do_tags host var to the list of the Droplet's tags").Bool()
+
+	createdAfter  = kingpin.Flag("created-after", "only include Droplets created at or after this RFC3339 timestamp or duration ago, e.g. 24h").String()
+	createdBefore = kingpin.Flag("created-before", "only include Droplets created before this RFC3339 timestamp or duration ago, e.g. 24h").String()
+
+	nameMatch  = kingpin.Flag("name-match", "only include Droplets whose name matches a shell-style glob such as web-*, can be specified multiple times").Strings()
+	namePrefix = kingpin.Flag("name-prefix", "only include Droplets whose name starts with this prefix").String()
+	ignoreCase = kingpin.Flag("ignore-case", "match --name-match, --name-prefix, and --ignore case-insensitively").Bool()
+
+	insecureHostKeys     = kingpin.Flag("insecure-host-keys", "disable SSH host key checking on every host, e.g. for brand-new Droplets").Bool()
+	insecureHostKeysTags = kingpin.Flag("disable-host-key-checking-for-tag", "disable SSH host key checking on Droplets with a tag, can be specified multiple times").Strings()
+
+	skipExhaustedProjects = kingpin.Flag("skip-exhausted-projects", "with --group-by-project, stop listing project resources once the project of every selected Droplet is known").Bool()
+
+	emitUngrouped = kingpin.Flag("emit-ungrouped", "add the Droplets that aren't in any tag or project group to an ungrouped group").Bool()
+
+	emitAllGroup = kingpin.Flag("emit-all-group", "list every host in an explicit all group at the top of the inventory").Bool()
+
+	networkPreferCIDR = kingpin.Flag("network-prefer-cidr", "use the Droplet's IPv4 address in this CIDR range, e.g. a VPC's, if it has one").String()
+
+	requestTimeout = kingpin.Flag("request-timeout", "timeout of every API request, within --timeout, e.g. 20s").Duration()
+
+	splitBy = kingpin.Flag("split-by", "write an inventory per region, tag, or project into the --out directory instead of a single file").Enum("region", "tag", "project")
+
+	tagVars          = kingpin.Flag("tag-vars", "set a do_tag_<key> host var for every tag in the form key:value, split at the first --tag-vars-separator").Bool()
+	tagVarsSeparator = kingpin.Flag("tag-vars-separator", "separator of the key and the value of the tags used by --tag-vars, defaults to :").Default(":").String()
+
+	dropletIDs = kingpin.Flag("droplet-id", "only include the Droplet with this ID, can be specified multiple times").Ints()
+
+	noGrouping = kingpin.Flag("no-grouping", "don't group hosts by region, tag, or project, unless --group-by-region, --group-by-tag, or --group-by-project is passed explicitly").Bool()
+
+	appendOut            = kingpin.Flag("append", "append the inventory to the --out file instead of overwriting it").Bool()
+	updateBetweenMarkers = kingpin.Flag("update-between-markers", "only replace the lines between # BEGIN do-inventory and # END do-inventory in the --out file, appending them if they're missing").Bool()
+
+	groupByVCPUs  = kingpin.Flag("group-by-vcpus", "group hosts by their number of vCPUs, e.g. vcpus_2").Bool()
+	groupByMemory = kingpin.Flag("group-by-memory", "group hosts by their memory in MB, e.g. mem_4096, or into the --memory-buckets tiers").Bool()
+	memoryBuckets = kingpin.Flag("memory-buckets", "comma-separated name=MB memory tiers for --group-by-memory, e.g. small=2048,medium=8192,large=32768").String()
+
+	anyTags = kingpin.Flag("any-tags", "comma-separated list of tags, only include Droplets that have at least one of them, same as --tag-require-any").String()
+)
+
+var (
+	generateCmd = kingpin.Command("generate", "generate the inventory, the default command").Default()
+	versionCmd  = kingpin.Command("version", "print the version, git commit, and build date")
 )
 
-var doRegions = []string{"ams1", "ams2", "ams3", "blr1", "fra1", "lon1", "nyc1", "nyc2", "nyc3", "sfo1", "sfo2", "sfo3", "sgp1", "tor1"}
+// accountUUID is the UUID of the account the --out file is written for
+var accountUUID string
+
+// accountHeader prefixes the comment recording the account UUID in --out files
+const accountHeader = "# do-ansible-inventory account: "
+
+// exitEmpty is the exit code when the inventory has no hosts
+const exitEmpty = 3
+
+// version, commit, and date describe the build. They're set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=...", the
+// version is also reported in the User-Agent.
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
 
 func main() {
-	kingpin.Parse()
+	metrics := &runMetrics{start: time.Now()}
 	log.SetHandler(cli.Default)
+	kingpin.Version(buildInfo())
+
+	args, err := configArgs(os.Args[1:])
+	if err != nil {
+		log.WithError(err).Fatal("couldn't load config")
+	}
+	explicit := trackExplicit("group-by-region", "group-by-tag", "group-by-project")
+	if kingpin.MustParse(kingpin.CommandLine.Parse(args)) == versionCmd.FullCommand() {
+		fmt.Println(buildInfo())
+		return
+	}
+
+	if *noGrouping {
+		for name, enabled := range map[string]*bool{
+			"group-by-region":  groupByRegion,
+			"group-by-tag":     groupByTag,
+			"group-by-project": groupByProject,
+		} {
+			if !explicit[name] {
+				*enabled = false
+			}
+		}
+	}
+
+	if *logFormat == "json" {
+		log.SetHandler(json.New(os.Stderr))
+	}
+	log.SetLevelFromString(*logLevel)
+	log.WithField("version", version).WithField("commit", commit).Info("starting do-ansible-inventory")
+
+	if *list {
+		*format = "json"
+	}
+
+	if *appendOut && *updateBetweenMarkers {
+		log.Fatal("--append and --update-between-markers can't be used together")
+	}
+	if *appendOut || *updateBetweenMarkers {
+		if *out == "" || *splitBy != "" || *skipUnchanged {
+			log.Fatal("--append and --update-between-markers require --out and can't be used with --split-by or --skip-unchanged")
+		}
+		if !hasComments() {
+			log.Fatalf("--append and --update-between-markers can't be used with --format %s", *format)
+		}
+	}
+
+	if *splitBy != "" {
+		if *out == "" {
+			log.Fatal("--split-by requires --out")
+		}
+		if *format != "ini" && *format != "yaml" && *format != "toml" {
+			log.Fatal("--split-by only supports the ini, yaml, and toml formats")
+		}
+	}
 
 	if *doToken == "" {
 		log.Info("no access token provided, attempting to look up doctl's access token")
-		token, context, err := doctlToken()
+		token, context, err := doctlToken(*doctlContext)
 		if err != nil {
 			log.WithError(err).Fatalf("couldn't look up token")
 		}
@@ -64,347 +337,819 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 	defer cancel()
 	client := godo.NewFromToken(*doToken)
-
-	// get droplets
-	if *tag != "" {
-		log.WithField("tag", *tag).Info("only selecting tagged Droplets")
-	}
-
-	log.Info("listing Droplets")
-	droplets, err := listDroplets(ctx, client, *tag)
+	err = godo.SetUserAgent(userAgent())(client)
 	if err != nil {
-		log.WithError(err).Fatal("couldn't fetch Droplets")
+		log.WithError(err).Fatal("couldn't set user agent")
 	}
+	if *apiURL != "" {
+		base, err := parseAPIURL(*apiURL)
+		if err != nil {
+			log.WithError(err).Fatal("couldn't parse --api-url")
+		}
 
-	// filter out ignored droplets
-	droplets = removeIgnored(droplets, *ignore)
-
-	// initialize some maps
-	var dropletsByRegion map[string][]string
-	if *groupByRegion {
-		dropletsByRegion = make(map[string][]string, len(doRegions))
-		for _, r := range doRegions {
-			dropletsByRegion[r] = []string{}
+		err = godo.SetBaseURL(base)(client)
+		if err != nil {
+			log.WithError(err).Fatal("couldn't set API URL")
 		}
 	}
+	log.WithField("url", client.BaseURL.String()).Debug("using API endpoint")
+	client.OnRequestCompleted(func(*http.Request, *http.Response) {
+		atomic.AddInt64(&metrics.apiCalls, 1)
+	})
+
+	// the account is recorded in a comment, which JSON doesn't have
+	// the account header has to be at the top of the file, which appended
+	// inventories aren't
+	if *out != "" && hasComments() && !*dryRun && *splitBy == "" && !*appendOut && !*updateBetweenMarkers {
+		reqCtx, cancel := requestContext(ctx)
+		account, _, err := client.Account.Get(reqCtx)
+		cancel()
+		if err != nil {
+			log.WithError(err).Fatal("couldn't get account")
+		}
+		accountUUID = account.UUID
 
-	var dropletsByTag map[string][]string
-	if *groupByTag {
-		dropletsByTag = make(map[string][]string, 0)
+		existing, err := outAccount(*out)
+		if err != nil {
+			log.WithError(err).Fatal("couldn't read existing inventory")
+		}
+		if existing != "" && existing != accountUUID {
+			ll := log.WithField("out", *out).WithField("account", existing)
+			if !*force {
+				ll.Fatal("existing inventory was written for a different account, use --force to overwrite it")
+			}
+			ll.Warn("overwriting inventory of a different account")
+		}
 	}
 
-	var inventory bytes.Buffer
-	dropletsByID := make(map[int]string, len(droplets))
-
-	for _, d := range droplets {
-		ll := log.WithField("droplet", d.Name)
-		ll.Info("processing")
+	cfg := inventory.Config{
+		SSHUser:                    *sshUser,
+		SSHPort:                    *sshPort,
+		ConnectionVarsAtGroupLevel: *connectionVarsAtGroupLevel,
+		SSHUserForTag:              *sshUserForTag,
+		SSHKeyFile:                 *sshKeyFile,
+		SSHKeyFileForTag:           *sshKeyFileForTag,
+		SSHExtraArgsFor:            *sshExtraArgsFor,
+		PythonInterpreter:          *pythonInterpreter,
+		Bastion:                    *bastion,
+		BastionTag:                 *bastionTag,
+		InsecureHostKeys:           *insecureHostKeys,
+		InsecureHostKeysTags:       *insecureHostKeysTags,
+		PrivateIPs:                 *privateIPs,
+		FQDNDomain:                 *fqdnDomain,
+		UseFQDN:                    *useFQDN,
+		PreferReservedIP:           *preferReservedIP,
+		PreferCIDR:                 *networkPreferCIDR,
+		Tag:                        *tag,
+		TagsUnion:                  inventory.SplitList(*tagsUnion),
+		TagRequireAll:              append(inventory.SplitList(*tagRequireAll), *matchAllTags...),
+		TagRequireAny:              append(inventory.SplitList(*tagRequireAny), inventory.SplitList(*anyTags)...),
+		Statuses:                   *statuses,
+		IncludeRegions:             *includeRegions,
+		ExcludeRegions:             *excludeRegions,
+		DropletIDs:                 *dropletIDs,
+		NameMatch:                  *nameMatch,
+		NamePrefix:                 *namePrefix,
+		IgnoreCase:                 *ignoreCase,
+		Ignore:                     *ignore,
+		IgnoreTags:                 *ignoreTag,
+		IgnoreRegex:                *ignoreRegex,
+		ExcludeWhere:               *excludeWhere,
+		GPUOnly:                    *gpuOnly,
+		GPUSizePrefixes:            *gpuSizePrefixes,
+		HostAliasFrom:              *hostAliasFrom,
+		Dedupe:                     *dedupe,
+		SortHostsBy:                *sortHostsBy,
+		HostVars:                   *hostVars,
+		FeaturesAsVar:              *featuresAsVar,
+		TagsAsVar:                  *tagsAsVar,
+		TagVars:                    *tagVars,
+		TagVarsSeparator:           *tagVarsSeparator,
+		IncludeBackupIDs:           *includeBackupIDs,
+		IncludePanelURL:            *includePanelURL,
+		IncludeLoadBalancers:       *includeLoadBalancers,
+		IncludeDatabases:           *includeDatabases,
+		GroupByRegion:              *groupByRegion,
+		Regions:                    inventory.SplitList(*regionList),
+		RegionVars:                 *regionVars,
+		RegionParent:               *regionParent,
+		TagParent:                  *tagParent,
+		RegionPrefix:               *regionPrefix,
+		TagPrefix:                  *tagPrefix,
+		ProjectPrefix:              *projectPrefix,
+		GroupByTag:                 *groupByTag,
+		HierarchicalTags:           *hierarchicalTags,
+		GroupByProject:             *groupByProject,
+		ExcludeDefaultProjectGroup: *excludeDefaultProjectGroup,
+		GroupByGPU:                 *groupByGPU,
+		GroupByImage:               *groupByImage,
+		GroupByFeature:             *groupByFeature,
+		GroupByVPC:                 *groupByVPC,
+		GroupByNamePrefix:          *groupByNamePrefix,
+		NamePrefixDelimiter:        *namePrefixDelimiter,
+		GroupByPrivateSubnet:       *groupByPrivateSubnet,
+		PrivateSubnetMask:          *privateSubnetMask,
+		GroupByLifecycle:           *groupByLifecycle,
+		LifecycleNewAge:            *lifecycleNewAge,
+		GroupByVCPUs:               *groupByVCPUs,
+		GroupByMemory:              *groupByMemory,
+		MemoryBuckets:              inventory.SplitList(*memoryBuckets),
+		BackupLookupConcurrency:    *backupLookupConcurrency,
+		ResolveConcurrency:         *resolveConcurrency,
+		ProjectConcurrency:         *projectConcurrency,
+		SkipExhaustedProjects:      *skipExhaustedProjects,
+		EmitUngrouped:              *emitUngrouped,
+		EmitAllGroup:               *emitAllGroup,
+		MaxRetries:                 *maxRetries,
+		RetryBaseDelay:             *retryBaseDelay,
+		RequestTimeout:             *requestTimeout,
+		PerPage:                    *perPage,
+	}
 
-		dropletsByID[d.ID] = d.Name
+	cfg.IPFamilies = inventory.SplitList(*ipPreference)
+	if *ipv6 {
+		if len(cfg.IPFamilies) > 0 {
+			log.Fatal("--ipv6 and --ip-preference can't be used together")
+		}
+		cfg.IPFamilies = []string{"ipv6"}
+	}
 
-		if *groupByRegion {
-			r := d.Region.Slug
-			dropletsByRegion[r] = append(dropletsByRegion[r], d.Name)
+	if *hostOverrideFile != "" {
+		cfg.HostOverrides, err = readLines(*hostOverrideFile)
+		if err != nil {
+			log.WithError(err).Fatal("couldn't read --host-override-file")
 		}
+	}
+	// flags take precedence over the file
+	cfg.HostOverrides = append(cfg.HostOverrides, *hostOverride...)
 
-		if *groupByTag {
-			for _, tag := range d.Tags {
-				dropletsByTag[tag] = append(dropletsByTag[tag], d.Name)
-			}
+	if *ignoreFile != "" {
+		names, err := readLines(*ignoreFile)
+		if err != nil {
+			log.WithError(err).Fatal("couldn't read --ignore-file")
 		}
+		cfg.Ignore = append(cfg.Ignore, names...)
+	}
+	// kingpin's Envar would only be used without --ignore flags, the env var adds
+	// to them instead so CI can set a base list
+	cfg.Ignore = append(cfg.Ignore, inventory.SplitList(os.Getenv("DO_INVENTORY_IGNORE"))...)
 
-		var (
-			ip  string
-			err error
-		)
-		if *privateIPs {
-			ip, err = d.PrivateIPv4()
-		} else {
-			ip, err = d.PublicIPv4()
+	if *changedSince != "" {
+		cfg.ChangedSince, err = parseTimeFlag(*changedSince, metrics.start)
+		if err != nil {
+			log.WithError(err).Fatal("couldn't parse --changed-since")
 		}
+	}
+	if *createdAfter != "" {
+		cfg.CreatedAfter, err = parseTimeFlag(*createdAfter, metrics.start)
 		if err != nil {
-			ll.WithError(err).Error("couldn't look up the Droplet's IP address, skipped")
-			continue
+			log.WithError(err).Fatal("couldn't parse --created-after")
 		}
+	}
+	if *createdBefore != "" {
+		cfg.CreatedBefore, err = parseTimeFlag(*createdBefore, metrics.start)
+		if err != nil {
+			log.WithError(err).Fatal("couldn't parse --created-before")
+		}
+	}
 
-		inventory.WriteString(d.Name)
-		inventory.WriteRune('\t')
-		if *sshUser != "" {
-			inventory.WriteString(fmt.Sprintf("ansible_user=%s ", *sshUser))
+	if *includeIDsFile != "" {
+		cfg.IncludeIDs, err = readIDsFile(*includeIDsFile)
+		if err != nil {
+			log.WithError(err).Fatal("couldn't read --include-ids-file")
 		}
-		if *sshPort != 0 {
-			inventory.WriteString(fmt.Sprintf("ansible_port=%d ", *sshPort))
+	}
+
+	var key string
+	var inv *inventory.Inventory
+	var stats inventory.Stats
+	if *cacheFile != "" {
+		key, err = cacheKey(cfg, *doToken)
+		if err != nil {
+			log.WithError(err).Fatal("couldn't compute the cache key")
 		}
-		if ip != "" {
-			inventory.WriteString(fmt.Sprintf("ansible_host=%s", ip))
-		} else {
-			ll.Warn("could not get the Droplet's IP address, using hostname")
+
+		var ok bool
+		inv, stats, ok = loadCache(*cacheFile, key, *cacheTTL)
+		if ok {
+			log.WithField("cache", *cacheFile).Info("using cached inventory")
 		}
-		inventory.WriteRune('\n')
 	}
-	inventory.WriteRune('\n')
-
-	// write the region groups
-	if *groupByRegion {
-		// loop over the doRegions slice to maintain alphabetic order
-		for _, region := range doRegions {
-			log.WithField("region", region).Info("building region group")
-			droplets := dropletsByRegion[region]
 
-			inventory.WriteString(fmt.Sprintf("[%s]", region))
-			inventory.WriteRune('\n')
+	if inv == nil {
+		inv, stats, err = inventory.Build(ctx, inventory.NewClient(client), cfg)
+		if err != nil {
+			fatalWithPartial(ctx, log.Log, err, "couldn't build inventory", inv)
+		}
 
-			for _, d := range droplets {
-				inventory.WriteString(d)
-				inventory.WriteRune('\n')
+		if *cacheFile != "" {
+			ll := log.WithField("cache", *cacheFile)
+			ll.Info("caching inventory")
+			err = writeCache(*cacheFile, key, inv, stats)
+			if err != nil {
+				ll.WithError(err).Warn("couldn't cache inventory")
 			}
-			inventory.WriteRune('\n')
+		}
+	}
+	metrics.dropletsListed = stats.DropletsListed
+	metrics.dropletsIgnored = stats.DropletsIgnored
+	metrics.hostsSkipped = stats.HostsSkipped
+	metrics.hostsNoIP = len(stats.NoIP)
+	metrics.hostsDuplicate = len(stats.Duplicates)
+
+	if *dryRun {
+		err = writeSummary(os.Stdout, inv, stats)
+		if err != nil {
+			log.WithError(err).Fatal("couldn't write summary")
 		}
 	}
 
-	// write the tag groups
-	if *groupByTag {
-		for tag, droplets := range dropletsByTag {
-			tag = sanitizeAnsibleGroup(tag)
-			log.WithField("tag", tag).Info("building tag group")
+	// --allow-empty only applies to writing the inventory, a dry run that
+	// matches nothing always fails
+	if inv.Hosts() == 0 && (*dryRun || !*allowEmpty) {
+		writeMetrics(metrics, inv)
+		warnSummary(stats)
+		if *dryRun {
+			log.Error("no Droplets matched, the inventory has no hosts")
+		} else {
+			log.Error("no Droplets matched, the inventory has no hosts, use --allow-empty to write it anyway")
+		}
+		os.Exit(exitEmpty)
+	}
 
-			inventory.WriteString(fmt.Sprintf("[%s]", tag))
-			inventory.WriteRune('\n')
+	if *dryRun {
+		writeMetrics(metrics, inv)
+		return
+	}
 
-			for _, d := range droplets {
-				inventory.WriteString(d)
-				inventory.WriteRune('\n')
-			}
-			inventory.WriteRune('\n')
+	if *fingerprintOut != "" {
+		ll := log.WithField("out", *fingerprintOut)
+		ll.Info("writing inventory fingerprint")
+		err = ioutil.WriteFile(*fingerprintOut, []byte(inv.Fingerprint()+"\n"), 0644)
+		if err != nil {
+			ll.WithError(err).Fatal("couldn't write inventory fingerprint")
 		}
 	}
 
-	// write the project groups
-	if *groupByProject {
-		log.Info("listing projects")
-		projects, _, err := client.Projects.List(ctx, nil)
+	if *hostVarsFor != "" {
+		rendered, err := inv.HostJSON(*hostVarsFor)
 		if err != nil {
-			log.WithError(err).Fatal("couldn't list projects")
+			log.WithError(err).Fatal("couldn't render host vars")
 		}
 
-		dropletsByProject := make(map[string][]string)
-		for _, project := range projects {
-			ll := log.WithField("project", project.Name)
-			ll.Info("listing project resources")
+		_, err = rendered.WriteTo(os.Stdout)
+		if err != nil {
+			log.WithError(err).Fatal("couldn't write host vars")
+		}
+		writeMetrics(metrics, inv)
+		return
+	}
 
-			resources, err := listProjectResources(ctx, client, project.ID)
+	if *splitBy != "" {
+		ll := log.WithField("dir", *out).WithField("split_by", *splitBy)
+		ll.Info("writing split inventories")
+		err = writeSplit(*out, *splitBy, inv)
+		if err != nil {
+			ll.WithError(err).Fatal("couldn't write split inventories")
+		}
+	} else {
+		// the inventory is streamed to the output, unless it has to be
+		// compared with the existing file first
+		write := func(w io.Writer) error {
+			return writeFormatted(w, inv)
+		}
+		skip := false
+		if *skipUnchanged && *out != "" {
+			rendered, err := render(inv)
 			if err != nil {
-				ll.WithError(err).Fatal("")
+				log.WithError(err).Fatal("couldn't render inventory")
 			}
-
-			for _, r := range resources {
-				if !strings.HasPrefix(r.URN, "do:droplet:") {
-					continue
-				}
-
-				id := strings.TrimPrefix(r.URN, "do:droplet:")
-				idInt, err := strconv.Atoi(id)
-				if err != nil {
-					ll.WithError(err).WithField("urn", r.URN).Error("parsing droplet ID, skipping")
-					continue
-				}
-
-				// skip droplets that aren't included in the inventory
-				droplet, exists := dropletsByID[idInt]
-				if !exists {
-					continue
-				}
-
-				dropletsByProject[project.Name] = append(dropletsByProject[project.Name], droplet)
+			skip = unchanged(*out, rendered.Bytes())
+			write = func(w io.Writer) error {
+				_, err := rendered.WriteTo(w)
+				return err
 			}
 		}
 
-		for project, droplets := range dropletsByProject {
-			project = sanitizeAnsibleGroup(project)
-			log.WithField("project", project).Info("building project group")
-
-			inventory.WriteString(fmt.Sprintf("[%s]", project))
-			inventory.WriteRune('\n')
-
-			for _, d := range droplets {
-				inventory.WriteString(d)
-				inventory.WriteRune('\n')
+		if skip {
+			log.WithField("out", *out).Info("unchanged, skipped write")
+		} else {
+			if *out != "" {
+				log.WithField("out", *out).Info("writing inventory to file")
+			}
+			err = writeInventory(write)
+			if err != nil {
+				log.WithError(err).Fatal("couldn't write inventory")
 			}
-			inventory.WriteRune('\n')
 		}
 	}
 
-	if *out != "" {
-		ll := log.WithField("out", *out)
-		ll.Info("writing inventory to file")
-		f, err := os.Create(*out)
-		if err != nil {
-			ll.WithError(err).Fatal("couldn't open file for writing")
-		}
-		defer f.Close()
-
-		_, err = inventory.WriteTo(f)
+	if *groupVarsDir != "" {
+		ll := log.WithField("dir", *groupVarsDir)
+		ll.Info("writing group vars")
+		err = writeGroupVars(*groupVarsDir, inv)
 		if err != nil {
-			ll.WithError(err).Fatal("couldn't write inventory to file")
+			ll.WithError(err).Fatal("couldn't write group vars")
 		}
-	} else {
-		inventory.WriteTo(os.Stdout)
 	}
 
+	writeMetrics(metrics, inv)
+	warnSummary(stats)
 	log.Info("done!")
 }
 
-func doctlToken() (string, string, error) {
-	type doctlConfig struct {
-		Context      string            `yaml:"context"`
-		AccessToken  string            `yaml:"access-token"`
-		AuthContexts map[string]string `yaml:"auth-contexts"`
+// writeMetrics writes the run's metrics to --metrics-out, if it's set. It's
+// called on every path once the inventory is built, including dry runs and
+// empty inventories, which monitoring needs the numbers of the most.
+func writeMetrics(metrics *runMetrics, inv *inventory.Inventory) {
+	if *metricsOut == "" {
+		return
 	}
 
-	cfgDir, err := os.UserConfigDir()
+	metrics.hosts = inv.Hosts()
+	metrics.groups = inv.Groups()
+
+	ll := log.WithField("out", *metricsOut)
+	ll.Info("writing metrics")
+	err := metrics.write(*metricsOut)
 	if err != nil {
-		return "", "", fmt.Errorf("couldn't look up user config dir: %w", err)
+		ll.WithError(err).Error("couldn't write metrics")
 	}
+}
 
-	cfgFile, err := ioutil.ReadFile(filepath.Join(cfgDir, "doctl", "config.yaml"))
+// warnSummary logs the Droplets that were skipped while building the
+// inventory, and the ones added without an IP address, at the end of the run,
+// since their own logs are only written at debug level
+func warnSummary(stats inventory.Stats) {
+	if len(stats.Skipped) > 0 {
+		log.Warnf("%d %s skipped: %s", len(stats.Skipped), pluralDroplets(len(stats.Skipped)), strings.Join(stats.Skipped, ", "))
+	}
+	if len(stats.NoAddress) > 0 {
+		log.Warnf("%d %s without an IP address, using the host name: %s", len(stats.NoAddress), pluralDroplets(len(stats.NoAddress)), strings.Join(stats.NoAddress, ", "))
+	}
+}
+
+// pluralDroplets returns "Droplet" or "Droplets" for n Droplets
+func pluralDroplets(n int) string {
+	if n == 1 {
+		return "Droplet"
+	}
+	return "Droplets"
+}
+
+// trackExplicit returns the set of the flags that were passed explicitly, on
+// the command line or in the config file, once the flags are parsed
+func trackExplicit(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		name := name
+		kingpin.CommandLine.GetFlag(name).Action(func(*kingpin.ParseContext) error {
+			set[name] = true
+			return nil
+		})
+	}
+
+	return set
+}
+
+// writeSummary writes the --dry-run summary of the inventory
+func writeSummary(w io.Writer, inv *inventory.Inventory, stats inventory.Stats) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Droplets selected:\t%d\n", stats.DropletsListed-stats.DropletsIgnored)
+	fmt.Fprintf(tw, "Droplets ignored:\t%d\n", stats.DropletsIgnored)
+	fmt.Fprintf(tw, "Hosts:\t%d\n", inv.Hosts())
+	if len(stats.NoIP) > 0 {
+		fmt.Fprintf(tw, "Skipped, no IP address:\t%d (%s)\n", len(stats.NoIP), strings.Join(stats.NoIP, ", "))
+	}
+	fmt.Fprintf(tw, "Groups:\t%d\n", inv.Groups())
+	for _, g := range inv.GroupSizes() {
+		fmt.Fprintf(tw, "  %s\t%d\n", g.Name, g.Hosts)
+	}
+
+	return tw.Flush()
+}
+
+// buildInfo describes the build for --version
+func buildInfo() string {
+	return fmt.Sprintf("do-ansible-inventory %s (commit %s, built %s)", version, commit, date)
+}
+
+// writeGroupVars writes the vars of each group with vars to <group>.yml in dir
+func writeGroupVars(dir string, inv *inventory.Inventory) error {
+	files, err := inv.GroupVarsFiles()
 	if err != nil {
-		return "", "", fmt.Errorf("couldn't read doctl's config.yaml: %w", err)
+		return err
 	}
 
-	cfg := doctlConfig{}
-	err = yaml.Unmarshal(cfgFile, &cfg)
+	err = os.MkdirAll(dir, 0755)
 	if err != nil {
-		return "", "", fmt.Errorf("couldn't unmarshal doctl's config.yaml: %w", err)
+		return err
 	}
 
-	switch cfg.Context {
-	case "default":
-		return cfg.AccessToken, cfg.Context, nil
-	default:
-		return cfg.AuthContexts[cfg.Context], cfg.Context, nil
+	for _, f := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, f.Group+".yml"), f.Content, 0644)
+		if err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-func sanitizeAnsibleGroup(s string) string {
-	// replace invalid characters
-	s = strings.NewReplacer(
-		" ", "_",
-		"-", "_",
-		":", "_",
-	).Replace(s)
+// writeSplit writes an inventory per region, tag, or project group into dir,
+// named inventory.<group>.<format>
+func writeSplit(dir, kind string, inv *inventory.Inventory) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, split := range inv.Split(kind) {
+		rendered, err := split.Inventory.Render(*format)
+		if err != nil {
+			return err
+		}
 
-	// group names cannot start with a digit
-	if '0' <= s[0] && s[0] <= '9' {
-		s = "_" + s
+		path := filepath.Join(dir, "inventory."+split.Group+"."+*format)
+		log.WithField("out", path).Info("writing inventory to file")
+		err = ioutil.WriteFile(path, rendered.Bytes(), 0644)
+		if err != nil {
+			return err
+		}
 	}
 
-	return s
+	return nil
 }
 
-func removeIgnored(droplets []godo.Droplet, ignored []string) []godo.Droplet {
-	if len(ignored) == 0 {
-		return droplets
+// parseAPIURL checks that the --api-url is an absolute http or https URL and
+// returns it with a trailing slash, so godo keeps its path when resolving the
+// API paths against it
+func parseAPIURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q isn't an http or https URL", s)
+	}
+
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
 	}
+	return u.String(), nil
+}
+
+// hasComments reports whether the --format can carry comments, which the JSON
+// formats can't
+func hasComments() bool {
+	return *format != "json" && *format != "prometheus"
+}
 
-	// copy ignored droplets into a map
-	ignoreList := make(map[string]interface{}, len(ignored))
-	for _, i := range ignored {
-		ignoreList[i] = struct{}{}
+// render renders the inventory in the --format
+func render(inv *inventory.Inventory) (*bytes.Buffer, error) {
+	if *format == "prometheus" {
+		return inv.PrometheusTargets(*metricsPort)
 	}
+	return inv.Render(*format)
+}
 
-	// remove ignored droplets from the list
-	newDroplets := droplets[:0]
-	for _, d := range droplets {
-		if _, ignored := ignoreList[d.Name]; ignored {
-			log.WithField("droplet", d.Name).Info("ignoring")
-			continue
+// writeFormatted writes the inventory in the --format to w
+func writeFormatted(w io.Writer, inv *inventory.Inventory) error {
+	if *format == "prometheus" {
+		targets, err := inv.PrometheusTargets(*metricsPort)
+		if err != nil {
+			return err
 		}
+		_, err = targets.WriteTo(w)
+		return err
+	}
+	return inv.Write(w, *format)
+}
 
-		newDroplets = append(newDroplets, d)
+// userAgent identifies do-ansible-inventory's API calls, with the optional
+// --user-agent-suffix appended
+func userAgent() string {
+	ua := "do-ansible-inventory/" + version
+	if *userAgentSuffix != "" {
+		ua += " " + *userAgentSuffix
 	}
 
-	return newDroplets
+	return ua
 }
 
-// get droplets w/ pagination
-func listDroplets(ctx context.Context, client *godo.Client, tag string) ([]godo.Droplet, error) {
-	droplets := []godo.Droplet{}
+// requestContext returns the context of a single API request made outside of
+// inventory.Build, which times out after --request-timeout if it's set
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *requestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, *requestTimeout)
+}
 
-	call := func(opt *godo.ListOptions) (interface{}, *godo.Response, error) {
-		if tag != "" {
-			return client.Droplets.ListByTag(ctx, tag, opt)
-		}
+// writeInventory writes the inventory with write to the --out file, or to
+// stdout if unset
+func writeInventory(write func(io.Writer) error) error {
+	if *out == "" {
+		return write(os.Stdout)
+	}
+	if *updateBetweenMarkers {
+		return writeBetweenMarkers(*out, write)
+	}
 
-		return client.Droplets.List(ctx, opt)
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if *appendOut {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
 	}
-	handler := func(d interface{}) error {
-		dd, ok := d.([]godo.Droplet)
-		if !ok {
-			return fmt.Errorf("listing Droplets")
+	f, err := os.OpenFile(*out, flag, 0666)
+	if err != nil {
+		return fmt.Errorf("couldn't open file for writing: %w", err)
+	}
+	defer f.Close()
+
+	if accountUUID != "" && hasComments() {
+		_, err = fmt.Fprintf(f, "%s%s\n", accountHeader, accountUUID)
+		if err != nil {
+			return fmt.Errorf("couldn't write inventory to file: %w", err)
 		}
-		droplets = append(droplets, dd...)
-		return nil
 	}
 
-	err := paginateGodo(ctx, call, handler)
+	err = write(f)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("couldn't write inventory to file: %w", err)
 	}
 
-	return droplets, nil
+	// writes may only fail once the file is closed
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't write inventory to file: %w", err)
+	}
+
+	return nil
 }
 
-// get project resources w/ pagination
-func listProjectResources(ctx context.Context, client *godo.Client, projectID string) ([]godo.ProjectResource, error) {
-	prs := []godo.ProjectResource{}
+// beginMarker and endMarker delimit the inventory in --out files written with
+// --update-between-markers
+const (
+	beginMarker = "# BEGIN do-inventory"
+	endMarker   = "# END do-inventory"
+)
+
+// writeBetweenMarkers replaces the lines between beginMarker and endMarker in
+// the file at path with the inventory written by write, keeping the rest of
+// the file. If the file doesn't exist or has no markers, the inventory is
+// appended between markers.
+func writeBetweenMarkers(path string, write func(io.Writer) error) error {
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("couldn't read file: %w", err)
+	}
 
-	call := func(opt *godo.ListOptions) (interface{}, *godo.Response, error) {
-		return client.Projects.ListResources(ctx, projectID, opt)
+	var rendered bytes.Buffer
+	err = write(&rendered)
+	if err != nil {
+		return err
+	}
+	if rendered.Len() > 0 && !bytes.HasSuffix(rendered.Bytes(), []byte("\n")) {
+		rendered.WriteRune('\n')
+	}
+
+	lines := strings.SplitAfter(string(existing), "\n")
+	begin, end := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case beginMarker:
+			if begin == -1 {
+				begin = i
+			}
+		case endMarker:
+			if begin != -1 && end == -1 {
+				end = i
+			}
+		}
+	}
+	if begin != -1 && end == -1 {
+		return fmt.Errorf("%s has a %q line without a matching %q", path, beginMarker, endMarker)
 	}
-	handler := func(r interface{}) error {
-		rr, ok := r.([]godo.ProjectResource)
-		if !ok {
-			return fmt.Errorf("listing project resources")
+
+	var b bytes.Buffer
+	if begin == -1 {
+		b.Write(existing)
+		if len(existing) > 0 && !bytes.HasSuffix(existing, []byte("\n")) {
+			b.WriteRune('\n')
 		}
-		prs = append(prs, rr...)
-		return nil
+		b.WriteString(beginMarker + "\n")
+		rendered.WriteTo(&b)
+		b.WriteString(endMarker + "\n")
+	} else {
+		b.WriteString(strings.Join(lines[:begin+1], ""))
+		rendered.WriteTo(&b)
+		b.WriteString(strings.Join(lines[end:], ""))
 	}
 
-	err := paginateGodo(ctx, call, handler)
+	err = ioutil.WriteFile(path, b.Bytes(), 0644)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("couldn't write inventory to file: %w", err)
 	}
 
-	return prs, nil
+	return nil
 }
 
-func paginateGodo(ctx context.Context, call func(*godo.ListOptions) (interface{}, *godo.Response, error), handler func(interface{}) error) error {
-	// create options. initially, these will be blank
-	opt := &godo.ListOptions{}
-	for {
-		results, resp, err := call(opt)
-		if err != nil {
-			return err
+// outAccount returns the account UUID recorded in the header of the inventory
+// at path, or an empty string if the file doesn't exist or has no header
+func outAccount(path string) (string, error) {
+	existing, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(existing), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			break
 		}
+		if strings.HasPrefix(line, accountHeader) {
+			return strings.TrimSpace(strings.TrimPrefix(line, accountHeader)), nil
+		}
+	}
+
+	return "", nil
+}
+
+// unchanged reports whether the file at path has the same content as the
+// rendered inventory, ignoring comment lines, blank lines, and whitespace
+func unchanged(path string, rendered []byte) bool {
+	existing, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	return normalizeInventory(existing) == normalizeInventory(rendered)
+}
 
-		err = handler(results)
+// normalizeInventory strips comments and blank lines from an INI inventory and
+// collapses the whitespace within each line
+func normalizeInventory(b []byte) string {
+	var lines []string
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.Join(strings.Fields(l), " ")
+		if l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, ";") {
+			continue
+		}
+
+		lines = append(lines, l)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// fatalWithPartial logs err and exits. If the run's timeout was reached and
+// --write-partial-on-timeout is set, the inventory assembled so far is written
+// first. With --out, it's written to <out>.partial so the last complete
+// inventory is kept, also with --split-by, where it's a single file next to
+// the directory. Without --out, it's written to stdout, prefixed with a
+// comment marking it as partial, unless the format has no comments.
+func fatalWithPartial(ctx context.Context, ll log.Interface, err error, msg string, inv *inventory.Inventory) {
+	if !*writePartialOnTimeout || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		ll.WithError(err).Fatal(msg)
+	}
+
+	ll.WithError(err).Error(msg)
+
+	if *out == "" && !hasComments() {
+		log.Warn("timeout reached, the format can't mark the inventory as partial, so it isn't written to stdout, use --out to write it to a .partial file")
+		os.Exit(1)
+	}
+	if inv == nil {
+		inv = &inventory.Inventory{}
+	}
+
+	write := func(w io.Writer) error {
+		if hasComments() {
+			_, err := io.WriteString(w, "# WARNING: partial inventory - the timeout was reached before all Droplets and groups were collected\n\n")
+			if err != nil {
+				return err
+			}
+		}
+		return writeFormatted(w, inv)
+	}
+
+	if *out == "" {
+		log.Warn("timeout reached, writing partial inventory")
+		err = write(os.Stdout)
 		if err != nil {
-			return nil
+			log.WithError(err).Fatal("couldn't write partial inventory")
 		}
+		os.Exit(1)
+	}
 
-		// if we are at the last page, break out the for loop
-		if resp.Links == nil || resp.Links.IsLastPage() {
-			break
+	partial := strings.TrimRight(*out, string(os.PathSeparator)) + ".partial"
+	ll = log.WithField("out", partial)
+	ll.Warn("timeout reached, writing partial inventory")
+	var buf bytes.Buffer
+	err = write(&buf)
+	if err == nil {
+		err = ioutil.WriteFile(partial, buf.Bytes(), 0644)
+	}
+	if err != nil {
+		ll.WithError(err).Fatal("couldn't write partial inventory")
+	}
+
+	os.Exit(1)
+}
+
+// doctlToken returns the access token of a doctl auth context and the
+// context's name. The current context is used if context is empty.
+func doctlToken(context string) (string, string, error) {
+	type doctlConfig struct {
+		Context      string            `yaml:"context"`
+		AccessToken  string            `yaml:"access-token"`
+		AuthContexts map[string]string `yaml:"auth-contexts"`
+	}
+
+	cfgDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't look up user config dir: %w", err)
+	}
+
+	cfgFile, err := ioutil.ReadFile(filepath.Join(cfgDir, "doctl", "config.yaml"))
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't read doctl's config.yaml: %w", err)
+	}
+
+	cfg := doctlConfig{}
+	err = yaml.Unmarshal(cfgFile, &cfg)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't unmarshal doctl's config.yaml: %w", err)
+	}
+
+	if context == "" {
+		context = cfg.Context
+	} else if _, ok := cfg.AuthContexts[context]; !ok && context != "default" {
+		return "", "", fmt.Errorf("doctl context %q doesn't exist", context)
+	}
+
+	switch context {
+	case "default":
+		return cfg.AccessToken, context, nil
+	default:
+		return cfg.AuthContexts[context], context, nil
+	}
+}
+
+// readLines reads a newline-delimited file, skipping blank lines and lines
+// starting with #
+func readLines(path string) ([]string, error) {
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, l := range strings.Split(string(f), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
 		}
 
-		page, err := resp.Links.CurrentPage()
+		lines = append(lines, l)
+	}
+
+	return lines, nil
+}
+
+// readIDsFile reads a newline-delimited file of Droplet IDs
+func readIDsFile(path string) ([]int, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(lines))
+	for _, l := range lines {
+		id, err := strconv.Atoi(l)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("invalid Droplet ID %q: %w", l, err)
 		}
 
-		// set the page we want for the next request
-		opt.Page = page + 1
+		ids = append(ids, id)
 	}
 
-	return nil
+	return ids, nil
+}
+
+// parseTimeFlag parses an RFC3339 timestamp, or a duration such as 24h that is
+// subtracted from now
+func parseTimeFlag(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC3339 timestamp nor a duration", s)
+	}
+
+	return t, nil
 }
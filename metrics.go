@@ -0,0 +1,83 @@
+/*
+Copyright 2020 Kamal Nasser All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runMetrics are counters collected during a run and written by --metrics-out
+type runMetrics struct {
+	start time.Time
+
+	dropletsListed  int
+	dropletsIgnored int
+	hostsSkipped    int
+	hostsNoIP       int
+	hostsDuplicate  int
+	hosts           int
+	groups          int
+	apiCalls        int64
+}
+
+// write writes the metrics in the Prometheus text format to path. The file is
+// written to a temporary file first and renamed so node_exporter's textfile
+// collector never reads a partial file.
+func (m *runMetrics) write(path string) error {
+	var b bytes.Buffer
+
+	metric := func(name, help string, value interface{}) {
+		b.WriteString(fmt.Sprintf("# HELP do_ansible_inventory_%s %s\n", name, help))
+		b.WriteString(fmt.Sprintf("# TYPE do_ansible_inventory_%s gauge\n", name))
+		b.WriteString(fmt.Sprintf("do_ansible_inventory_%s %v\n", name, value))
+	}
+
+	metric("droplets_listed", "Number of Droplets listed from the API.", m.dropletsListed)
+	metric("droplets_ignored", "Number of listed Droplets removed by filters and ignore rules.", m.dropletsIgnored)
+	metric("hosts_skipped", "Number of selected Droplets that weren't added to the inventory.", m.hostsSkipped)
+	metric("hosts_skipped_no_ip", "Number of Droplets skipped because their IP address couldn't be looked up.", m.hostsNoIP)
+	metric("hosts_skipped_duplicate", "Number of Droplets skipped because their host name was already used.", m.hostsDuplicate)
+	metric("hosts", "Number of hosts in the inventory.", m.hosts)
+	metric("groups", "Number of groups in the inventory.", m.groups)
+	metric("api_calls", "Number of DigitalOcean API requests made.", m.apiCalls)
+	metric("run_duration_seconds", "Duration of the run in seconds.", time.Since(m.start).Seconds())
+	metric("last_run_timestamp_seconds", "Unix time the run finished at.", time.Now().Unix())
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = b.WriteTo(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	// TempFile creates the file with 0600, relax it so the collector can read it
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}